@@ -1,20 +1,38 @@
 package main
 
 import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
 	"crypto/md5"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"math"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
-	// "time"
+	"text/template"
+	"time"
 )
 
 const (
@@ -24,13 +42,107 @@ options:
         -h|--help      print this help and exit
         -V|--version   print script version and exit
 commands:
-        add            add new migrations script with properly defined name
+        add [description]
+                       add new migrations script with properly defined name
         collect        collect migrations on submodules between commits into migrations catalog
-        check          check unregtistered migrations files at submodules`
+        check          check unregtistered migrations files at submodules
+        diff [key]     show difference between catalog migrations and their sources
+        verify         verify checksums of catalog files and their sources
+        render <key>|--range <from>..<to>
+                       write up and down scripts with inlined includes
+        bundle         write deploy and rollback scripts between release tags
+        package        write <project>-<version>-<release>-migrations.tar.gz with catalog and manifest
+        verify-package <archive>
+                       verify package files against its manifest
+        export         export catalog to golang-migrate, flyway or liquibase layout
+        import --format flyway|golang-migrate <dir>
+                       import migrations of other tool into catalog
+        apply          apply pending migrations, changed repeatable scripts and callbacks to database
+        rollback       roll back last applied migrations
+        status         print applied and pending migrations of database and lock holder
+        unlock         print holder of apply and rollback lock, remove stale lock or any lock with --force
+        renumber [key] move later added migration of same number conflict, or key, to next free number
+        upgrade-meta   rewrite #migration: headers of catalog files to #migration-v2: format
+catalog:
+        <key>.up.sql and <key>.down.sql pairs of migrations,
+        <name>.repeatable.sql scripts of views, functions and packages without down pair,
+        bundle runs them after migrations when their content changed,
+        <event>.sql and <event>__<description>.sql callbacks of bundle scripts, events are
+        beforeMigrate, beforeEachMigrate, afterEachMigrate, afterMigrate and same *Rollback ones,
+        callbacks of one event run in name order,
+        "#transaction per-file|per-statement|off" line of script sets transaction of apply and rollback:
+        whole script (default), each statement or none
+config:
+        scripts/migration.json, "sources" list of submodules, dir and tar migrations sources,
+        "only" and "exclude" globs of sources,
+        "sign_key" and "verify_key" ed25519 PEM key files for migrations.lock,
+        "rules" policy error, warning or off of check rules gap, duplicate, lower-than-tagged, added-after-release,
+        modified-after-release, transaction, default is error, but warning for added-after-release,
+        "naming" strategy of add: counter (default) -N, timestamp -YYYYMMDDHHMMSS UTC or order,
+        order is timestamp naming with migrations/ORDER list of migrations in apply order,
+        "history_table" table of applied migrations, default is migration_history,
+        "driver" and "dsn" database/sql driver and data source name, MIGRATION_DSN overrides "dsn",
+        "dialect" postgres, mysql, oracle or sqlite, rule transaction checks scripts against it,
+        apply and rollback take advisory lock of postgres and mysql, other dialects lock row of <history_table>_lock,
+        "lock_ttl" duration of lock row, it is prolonged while lock is held, default is 15m,
+        status and unlock report lock row as stale once advisory lock is released or row is expired, unlock removes it
+go migrations:
+        data migrations are registered by Register(key, up, down) from init of files built
+        together with this one, which import database drivers too:
+        go build -o migration scripts/migration.go scripts/data_migrations.go
+        Go migrations take key slots of catalog, they are run by apply and rollback only
+check and collect options:
+        --only <glob>     use only sources matching glob, could be repeated
+        --exclude <glob>  skip sources matching glob, could be repeated
+add options:
+        --no-help         do not include help template into created files
+        --dir <path>      create files in path instead of ./migrations
+        --edit            open created files in $VISUAL or $EDITOR, remove them if left without statements
+        --template <path> text/template for both up and down files, default scripts/migration.template.sql
+        --up-template <path>, --down-template <path>
+                          separate templates for up and down files, template fields are
+                          .Project .Version .Release .Number .Description .Name .Direction .Author .Date
+render options:
+        --out <dir>       directory for rendered scripts, default is current directory
+bundle options:
+        --from <tag>      release installed in database, default is empty database
+        --to <tag>        target release, default is current catalog
+        --out <dir>       directory for scripts, default is current directory
+package options:
+        --out <dir>       directory for archive, default is current directory
+export options:
+        --format <name>   golang-migrate, flyway or liquibase
+        --out <dir>       output directory
+apply, rollback and status options:
+        --driver <name>   database/sql driver
+        --dsn <dsn>       data source name
+apply and rollback options:
+        --lock-timeout <duration>
+                          wait for lock held by other run, default is to fail at once
+rollback options:
+        --count <n>       number of migrations to roll back, default is 1
+unlock options:
+        --force           remove lock and end database session holding it
+diff options:
+        --stat            print only changed files summary
+collect options:
+        --sign-key <path> sign migrations.lock with ed25519 private key (PKCS#8 PEM)
+check options:
+        --ref <commit>    check catalog and submodule gitlinks at commit, works on bare repository
+        --locked          fail if catalog deviates from migrations.lock, both are taken at commit with --ref
+        --verify-key <path>
+                          verify migrations.lock signature with ed25519 public key (PKIX PEM)
+        --allow-amend <key> --reason <text>
+                          accept change of released migration, reason is recorded in #amended: line`
 	MiniHelpDir  = "scripts/migration.template.sql"
 	MigrationDir = "./migrations"
 	IncludeHelp  = true
 	DescribePath = "scripts/describe.sh"
+	ConfigPath   = "scripts/migration.json"
+	LockPath     = "./migrations.lock"
+	OrderFile    = "ORDER"
+	HistoryTable = "migration_history"
+	LockTTL      = 15 * time.Minute
 	GitBashPath  = "C:\\Program Files\\Git\\bin\\bash.exe"
 	Shell        = "bin/bash"
 )
@@ -76,13 +188,229 @@ func main() {
 
 	switch args[0] {
 	case "add":
-		add()
+		addFlags := flag.NewFlagSet("add", flag.ContinueOnError)
+		addFlags.Usage = func() {}
+		opts := addOptions{}
+		noHelp := addFlags.Bool("no-help", !IncludeHelp, "do not include help template")
+		addFlags.StringVar(&opts.dir, "dir", MigrationDir, "migrations directory")
+		templateFile := addFlags.String("template", MiniHelpDir, "template for up and down files")
+		addFlags.StringVar(&opts.upTemplate, "up-template", "", "template for up file")
+		addFlags.StringVar(&opts.downTemplate, "down-template", "", "template for down file")
+		addFlags.BoolVar(&opts.edit, "edit", false, "open created files in editor")
+		addArgs, err := parseArgs(addFlags, args[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unknown flag provided\n")
+			os.Exit(1)
+		}
+		if opts.upTemplate == "" {
+			opts.upTemplate = *templateFile
+		}
+		if opts.downTemplate == "" {
+			opts.downTemplate = *templateFile
+		}
+		if *noHelp {
+			opts.upTemplate, opts.downTemplate = "", ""
+		}
+		opts.description = strings.Join(addArgs, " ")
+		if err := add(opts); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
 		os.Exit(0)
 	case "collect":
-		collect()
+		collectFlags := flag.NewFlagSet("collect", flag.ContinueOnError)
+		collectFlags.Usage = func() {}
+		filter := sourceFlags(collectFlags)
+		signKey := collectFlags.String("sign-key", "", "ed25519 private key to sign lock file")
+		if err := collectFlags.Parse(args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unknown flag provided\n")
+			os.Exit(1)
+		}
+		collect(*filter, *signKey)
+		os.Exit(0)
+	case "diff":
+		diffFlags := flag.NewFlagSet("diff", flag.ContinueOnError)
+		diffFlags.Usage = func() {}
+		stat := diffFlags.Bool("stat", false, "print summary only")
+		diffArgs, err := parseArgs(diffFlags, args[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unknown flag provided\n")
+			os.Exit(1)
+		}
+		key := ""
+		if len(diffArgs) > 0 {
+			key = diffArgs[0]
+		}
+		diff(key, *stat)
+		os.Exit(0)
+	case "verify":
+		verify()
+		os.Exit(0)
+	case "render":
+		renderFlags := flag.NewFlagSet("render", flag.ContinueOnError)
+		renderFlags.Usage = func() {}
+		keyRange := renderFlags.String("range", "", "range of migrations from..to")
+		out := renderFlags.String("out", ".", "output directory")
+		renderArgs, err := parseArgs(renderFlags, args[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unknown flag provided\n")
+			os.Exit(1)
+		}
+		from, to := "", ""
+		if len(renderArgs) > 0 {
+			from, to = renderArgs[0], renderArgs[0]
+		}
+		if *keyRange != "" {
+			var ok bool
+			from, to, ok = strings.Cut(*keyRange, "..")
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Error: range must be <from>..<to>\n")
+				os.Exit(1)
+			}
+		}
+		if from == "" {
+			fmt.Fprintf(os.Stderr, "Error: migration key or --range is required\n")
+			os.Exit(1)
+		}
+		if err := render(from, to, *out); err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "bundle":
+		bundleFlags := flag.NewFlagSet("bundle", flag.ContinueOnError)
+		bundleFlags.Usage = func() {}
+		from := bundleFlags.String("from", "", "installed release tag")
+		to := bundleFlags.String("to", "", "target release tag")
+		out := bundleFlags.String("out", ".", "output directory")
+		if err := bundleFlags.Parse(args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unknown flag provided\n")
+			os.Exit(1)
+		}
+		if err := bundle(*from, *to, *out); err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "package":
+		packageFlags := flag.NewFlagSet("package", flag.ContinueOnError)
+		packageFlags.Usage = func() {}
+		out := packageFlags.String("out", ".", "output directory")
+		if err := packageFlags.Parse(args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unknown flag provided\n")
+			os.Exit(1)
+		}
+		if err := packageMigrations(*out); err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "verify-package":
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "Error: archive is required\n")
+			os.Exit(1)
+		}
+		verifyPackage(args[1])
+		os.Exit(0)
+	case "export":
+		exportFlags := flag.NewFlagSet("export", flag.ContinueOnError)
+		exportFlags.Usage = func() {}
+		format := exportFlags.String("format", "", "target layout")
+		out := exportFlags.String("out", "", "output directory")
+		if err := exportFlags.Parse(args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unknown flag provided\n")
+			os.Exit(1)
+		}
+		if *format == "" || *out == "" {
+			fmt.Fprintf(os.Stderr, "Error: --format and --out are required\n")
+			os.Exit(1)
+		}
+		if err := export(*format, *out); err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "import":
+		importFlags := flag.NewFlagSet("import", flag.ContinueOnError)
+		importFlags.Usage = func() {}
+		format := importFlags.String("format", "", "source layout")
+		importArgs, err := parseArgs(importFlags, args[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unknown flag provided\n")
+			os.Exit(1)
+		}
+		if *format == "" || len(importArgs) != 1 {
+			fmt.Fprintf(os.Stderr, "Error: --format and directory are required\n")
+			os.Exit(1)
+		}
+		if err := importMigrations(*format, importArgs[0]); err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "apply", "rollback", "status", "unlock":
+		dbFlagSet := flag.NewFlagSet(args[0], flag.ContinueOnError)
+		dbFlagSet.Usage = func() {}
+		opts := dbFlags(dbFlagSet)
+		count := 1
+		force := false
+		switch args[0] {
+		case "apply":
+			dbFlagSet.DurationVar(&opts.lockTimeout, "lock-timeout", 0, "wait for lock")
+		case "rollback":
+			dbFlagSet.DurationVar(&opts.lockTimeout, "lock-timeout", 0, "wait for lock")
+			dbFlagSet.IntVar(&count, "count", 1, "number of migrations to roll back")
+		case "unlock":
+			dbFlagSet.BoolVar(&force, "force", false, "remove lock")
+		}
+		if err := dbFlagSet.Parse(args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unknown flag provided\n")
+			os.Exit(1)
+		}
+		var err error
+		switch args[0] {
+		case "apply":
+			err = apply(*opts)
+		case "rollback":
+			err = rollback(*opts, count)
+		case "unlock":
+			err = unlock(*opts, force)
+		default:
+			err = status(*opts)
+		}
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "renumber":
+		if len(args) > 1 {
+			renumber(args[1])
+		} else {
+			renumber("")
+		}
+		os.Exit(0)
+	case "upgrade-meta":
+		upgradeMeta()
 		os.Exit(0)
 	case "check":
-		check()
+		checkFlags := flag.NewFlagSet("check", flag.ContinueOnError)
+		checkFlags.Usage = func() {}
+		ref := checkFlags.String("ref", "", "commit to check without worktree")
+		opts := checkOptions{filter: sourceFlags(checkFlags)}
+		checkFlags.BoolVar(&opts.locked, "locked", false, "check catalog against lock file")
+		checkFlags.StringVar(&opts.verifyKey, "verify-key", "", "ed25519 public key to verify lock file")
+		checkFlags.Var(&opts.allowAmend, "allow-amend", "accept change of released migration")
+		checkFlags.StringVar(&opts.reason, "reason", "", "reason of released migration change")
+		if err := checkFlags.Parse(args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unknown flag provided\n")
+			os.Exit(1)
+		}
+		if *ref != "" {
+			checkRef(*ref, opts)
+		} else {
+			check(opts)
+		}
 		os.Exit(0)
 	default:
 		fmt.Fprintf(os.Stderr, "Error: Unknown command '%s'\n", args[0])
@@ -90,16 +418,72 @@ func main() {
 	}
 }
 
+// parses flags placed before and after positional arguments, returns positional arguments
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
 func help() {
 	fmt.Println(Help)
 }
 
-func minihelp() string {
-	text, err := os.ReadFile(MiniHelpDir)
+// migrationTemplate is a data of up and down templates used by add
+type migrationTemplate struct {
+	Project     string
+	Version     string
+	Release     string
+	Number      int
+	Description string
+	Name        string
+	Direction   string
+	Author      string
+	Date        string
+}
+
+// renders text/template file, empty file name gives empty content
+func renderTemplate(file string, data migrationTemplate) (string, error) {
+	if file == "" {
+		return "", nil
+	}
+	text, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read template: %v", err)
+	}
+	tmpl, err := template.New(filepath.Base(file)).Option("missingkey=error").Parse(string(text))
 	if err != nil {
-		fmt.Println("Error reading help file:", err)
+		return "", fmt.Errorf("failed to parse template %s: %v", file, err)
+	}
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("failed to execute template %s: %v", file, err)
+	}
+	return out.String() + "\n", nil
+}
+
+// author for templates is git user.name or USER
+func author() string {
+	if output, err := runGit("config", "user.name"); err == nil && strings.TrimSpace(string(output)) != "" {
+		return strings.TrimSpace(string(output))
 	}
-	return string(text)
+	return os.Getenv("USER")
+}
+
+var descriptionReplacer = regexp.MustCompile(`[^a-z0-9]+`)
+
+// converts description to file name suffix, "Add users table" is add_users_table
+func migrationSuffix(description string) string {
+	return strings.Trim(descriptionReplacer.ReplaceAllString(strings.ToLower(description), "_"), "_")
 }
 
 func version() {
@@ -130,7 +514,16 @@ func describe(arg string) (string, error) {
 	return strings.ReplaceAll(string(output), "\n", ""), nil
 }
 
-func add() error {
+// addOptions are add command arguments, empty template means no template
+type addOptions struct {
+	description  string
+	dir          string
+	upTemplate   string
+	downTemplate string
+	edit         bool
+}
+
+func add(opts addOptions) error {
 	project, err := describe("project")
 	if err != nil {
 		log.Fatal(err)
@@ -147,29 +540,89 @@ func add() error {
 	baseName := fmt.Sprintf("%s-%s-%s", project, version, release)
 	fmt.Printf("Add migration script %s\n", baseName)
 
-	increment, err := FindLastMigrationNumber(MigrationDir, baseName)
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	increment, err := nextMigrationNumber(config.Naming, opts.dir, baseName, time.Now())
 	if err != nil {
-		return fmt.Errorf("failed to find last migration: %v", err)
+		return err
 	}
-	increment++
 
 	migrationFile := fmt.Sprintf("%s-%d", baseName, increment)
-	err = CreateMigrationFiles(MigrationDir, migrationFile, IncludeHelp)
+	if suffix := migrationSuffix(opts.description); suffix != "" {
+		migrationFile += "_" + suffix
+	}
+	data := migrationTemplate{
+		Project:     project,
+		Version:     version,
+		Release:     release,
+		Number:      increment,
+		Description: opts.description,
+		Name:        migrationFile,
+		Author:      author(),
+		Date:        time.Now().Format("2006-01-02"),
+	}
+	data.Direction = "up"
+	upContent, err := renderTemplate(opts.upTemplate, data)
+	if err != nil {
+		return err
+	}
+	data.Direction = "down"
+	downContent, err := renderTemplate(opts.downTemplate, data)
+	if err != nil {
+		return err
+	}
+	err = CreateMigrationFiles(opts.dir, migrationFile, upContent, downContent)
 	if err != nil {
 		return fmt.Errorf("failed to create migration files: %v", err)
 	}
 
-	fmt.Printf("Created migration files:\n   %s/%s.up.sql\n   %s/%s.down.sql\n",
-		MigrationDir, migrationFile, MigrationDir, migrationFile)
+	if config.Naming == "order" {
+		if err := appendOrder(opts.dir, migrationFile); err != nil {
+			return fmt.Errorf("failed to update %s: %v", OrderFile, err)
+		}
+	}
+
+	if opts.edit {
+		if err := editMigrationFiles(opts.dir, migrationFile); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("Created migration files:\n   %s/%s.up.sql\n   %s/%s.down.sql\n",
+			opts.dir, migrationFile, opts.dir, migrationFile)
+	}
 
+	if err := refreshLock(opts.dir); err != nil {
+		return fmt.Errorf("failed to write lock file: %v", err)
+	}
 	return nil
 }
 
+// nextMigrationNumber returns number of new migration by naming strategy
+func nextMigrationNumber(naming, dir, baseName string, now time.Time) (int, error) {
+	switch naming {
+	case "", "counter":
+		last, err := FindLastMigrationNumber(dir, baseName)
+		if err != nil {
+			return 0, fmt.Errorf("failed to find last migration: %v", err)
+		}
+		return last + 1, nil
+	case "timestamp", "order":
+		return strconv.Atoi(now.UTC().Format("20060102150405"))
+	default:
+		return 0, fmt.Errorf("unknown naming strategy '%s' in %s", naming, ConfigPath)
+	}
+}
+
 func FindLastMigrationNumber(dir, baseName string) (int, error) {
-	pattern := regexp.MustCompile(fmt.Sprintf(`^%s-(\d+)\.(up|down)\.sql$`, regexp.QuoteMeta(baseName)))
+	pattern := regexp.MustCompile(fmt.Sprintf(`^%s-(\d+)(_[a-z0-9_]+)?\.(up|down)\.sql$`, regexp.QuoteMeta(baseName)))
 	var maxNum int
 
 	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
 	if err != nil {
 		return 0, fmt.Errorf("failed to read directory %s: %v", dir, err)
 	}
@@ -190,60 +643,261 @@ func FindLastMigrationNumber(dir, baseName string) (int, error) {
 			}
 		}
 	}
+	// slots of Go migrations
+	for key := range goMigrations {
+		if base, num, _, ok := parseMigrationKey(key); ok && base == baseName && num > maxNum {
+			maxNum = num
+		}
+	}
 
 	return maxNum, nil
 }
 
-func CreateMigrationFiles(dir, baseName string, includeHelp bool) error {
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return err
+// opens created files in editor and removes them if user left only comments
+func editMigrationFiles(dir, baseName string) error {
+	upPath := filepath.Join(dir, baseName+".up.sql")
+	downPath := filepath.Join(dir, baseName+".down.sql")
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	args := append(strings.Fields(editor), upPath, downPath)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to run editor %s: %v", editor, err)
+	}
+
+	empty := true
+	for _, file := range []string{upPath, downPath} {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if hasStatements(string(content)) {
+			empty = false
+		}
+	}
+	if empty {
+		if err := os.Remove(upPath); err != nil {
+			return err
+		}
+		if err := os.Remove(downPath); err != nil {
+			return err
+		}
+		if err := renameOrder(dir, baseName, ""); err != nil {
+			return fmt.Errorf("failed to update %s: %v", OrderFile, err)
+		}
+		fmt.Printf("Nothing created, migration %s has no statements\n", baseName)
+		return nil
+	}
+	fmt.Printf("Created migration files:\n   %s\n   %s\n", upPath, downPath)
+	return nil
+}
+
+// reports if script has anything to execute besides '#' and '--' comment lines, /* */ comments and '/' delimiters
+func hasStatements(content string) bool {
+	inBlock := false
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if inBlock {
+			end := strings.Index(line, "*/")
+			if end < 0 {
+				continue
+			}
+			inBlock = false
+			line = strings.TrimSpace(line[end+2:])
+		}
+		if strings.HasPrefix(line, "/*") {
+			end := strings.Index(line, "*/")
+			if end < 0 {
+				inBlock = true
+				continue
+			}
+			line = strings.TrimSpace(line[end+2:])
+		}
+		if line == "" || line == "/" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "--") {
+			continue
+		}
+		return true
 	}
+	return false
+}
+
+var ddlPattern = regexp.MustCompile(`(?i)^\s*(create|alter|drop|truncate|rename|comment\s+on|grant|revoke)\b`)
+
+// returns migration script without meta header and "# name" comment line written by add
+func migrationBody(content string) string {
+	_, body := splitMigrationMeta(content)
+	first, rest, _ := strings.Cut(body, "\n")
+	if strings.HasPrefix(first, "# ") && strings.HasSuffix(strings.TrimSpace(first), ".sql") {
+		return rest
+	}
+	return body
+}
+
+func hasNoopMark(content string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		if strings.TrimSpace(line) == "#noop" || strings.HasPrefix(strings.TrimSpace(line), "#noop ") {
+			return true
+		}
+	}
+	return false
+}
+
+func hasDDL(content string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		if ddlPattern.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
 
-	upContent := fmt.Sprintf("# %s.up.sql\n", baseName)
-	if includeHelp {
-		upContent += minihelp() + "\n"
+// checkNoEffect reports catalog migrations without statements, down scripts left as template
+// while up script has DDL and pairs with identical up and down scripts, #noop line marks intentional ones
+func checkNoEffect(mainUp, mainDown map[string]string) []string {
+	tmpl, _ := os.ReadFile(MiniHelpDir)
+	helpTemplate := strings.TrimSpace(string(tmpl))
+	var found []string
+	for key, upPath := range mainUp {
+		downPath, hasDown := mainDown[key]
+		upContent, err := os.ReadFile(upPath)
+		if err != nil {
+			continue
+		}
+		up := migrationBody(string(upContent))
+		if !hasStatements(up) && !hasNoopMark(up) {
+			found = append(found, upPath+" (no statements)")
+		}
+		if !hasDown {
+			continue
+		}
+		downContent, err := os.ReadFile(downPath)
+		if err != nil {
+			continue
+		}
+		down := migrationBody(string(downContent))
+		if hasNoopMark(up) || hasNoopMark(down) {
+			continue
+		}
+		switch {
+		case helpTemplate != "" && strings.TrimSpace(down) == helpTemplate && hasDDL(up):
+			found = append(found, downPath+" (template only, but up script has DDL)")
+		case !hasStatements(down):
+			found = append(found, downPath+" (no statements)")
+		case up == down:
+			found = append(found, key+" (up and down scripts are identical)")
+		}
+	}
+	for key, downPath := range mainDown {
+		if _, ok := mainUp[key]; ok {
+			continue
+		}
+		if content, err := os.ReadFile(downPath); err == nil && !hasStatements(migrationBody(string(content))) && !hasNoopMark(string(content)) {
+			found = append(found, downPath+" (no statements)")
+		}
 	}
-	if err := os.WriteFile(filepath.Join(dir, baseName+".up.sql"), []byte(upContent), 0644); err != nil {
+	sort.Strings(found)
+	return found
+}
+
+// creates up and down files with name comment line followed by rendered templates
+func CreateMigrationFiles(dir, baseName, upTemplate, downTemplate string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
 		return err
 	}
 
-	downContent := fmt.Sprintf("# %s.down.sql\n", baseName)
-	if includeHelp {
-		downContent += minihelp() + "\n"
+	upPath := filepath.Join(dir, baseName+".up.sql")
+	upContent := fmt.Sprintf("# %s.up.sql\n", baseName) + upTemplate
+	if err := writeNewFile(upPath, []byte(upContent)); err != nil {
+		return err
 	}
-	if err := os.WriteFile(filepath.Join(dir, baseName+".down.sql"), []byte(downContent), 0644); err != nil {
+
+	downContent := fmt.Sprintf("# %s.down.sql\n", baseName) + downTemplate
+	if err := writeNewFile(filepath.Join(dir, baseName+".down.sql"), []byte(downContent)); err != nil {
+		os.Remove(upPath)
 		return err
 	}
 
 	return nil
 }
 
-func collect() {
+// writeNewFile writes file which must not exist, so migration of same name is not overwritten
+func writeNewFile(file string, content []byte) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s already exists", file)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func collect(filter sourceFilter, signKey string) {
 	mainUp, mainDown, err := findMigrationFiles(MigrationDir)
 	if err != nil {
 		fmt.Println("Error finding migration files:", err)
 		os.Exit(1)
 	}
 
-	submodules, err := getSubmodules()
+	mainRepeatable, err := findRepeatableFiles(MigrationDir)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Println("Error finding repeatable files:", err)
+		os.Exit(1)
+	}
+	mainCallbacks, err := findCallbackFiles(MigrationDir)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Println("Error finding callback files:", err)
+		os.Exit(1)
+	}
+
+	sources, skipped, err := getSources(filter)
+	if err != nil {
+		fmt.Println("Error getting sources:", err)
+		os.Exit(1)
+	}
+	printSkipped(skipped)
+	config, err := loadConfig()
 	if err != nil {
-		fmt.Println("Error getting submodules:", err)
+		fmt.Println("ERROR:", err)
 		os.Exit(1)
 	}
 
 	collected := 0
-	for _, sub := range submodules {
-		subMigDir := filepath.Join(sub, "migrations")
+	// keys of collected pairs for ORDER
+	collectedKeys := make(map[string]string)
+	// callback paths of sources by name, the first source gives callback
+	callbackPaths := make(map[string]string)
+	callbackOrigins := make(map[string]string)
+	for _, source := range sources {
+		subMigDir, err := source.Dir()
+		if err != nil {
+			fmt.Println("Error opening source:", err)
+			continue
+		}
+		meta := migrationMeta{submodule: source.Name(), commit: source.Commit()}
 		subUp, subDown, _ := findMigrationFiles(subMigDir)
 		for key, upPath := range subUp {
 			if _, ok := mainUp[key]; !ok {
 				// copy up
 				targetUp := filepath.Join(MigrationDir, key+".up.sql")
-				if err := copyFileWithMeta(upPath, targetUp, upPath); err != nil {
+				if err := copyFileWithMeta(upPath, targetUp, meta.withSource(source.Origin(upPath))); err != nil {
 					fmt.Println("Error copying file with meta:", err)
 					continue
 				}
 				collected++
+				collectedKeys[key] = targetUp
 				// copying include-files
 				copyIncludes(upPath, filepath.Dir(targetUp))
 			}
@@ -251,14 +905,63 @@ func collect() {
 		for key, downPath := range subDown {
 			if _, ok := mainDown[key]; !ok {
 				targetDown := filepath.Join(MigrationDir, key+".down.sql")
-				if err := copyFileWithMeta(downPath, targetDown, downPath); err != nil {
+				if err := copyFileWithMeta(downPath, targetDown, meta.withSource(source.Origin(downPath))); err != nil {
 					fmt.Println("Error copying file with meta:", err)
 					continue
 				}
 				collected++
+				collectedKeys[key] = targetDown
 				copyIncludes(downPath, filepath.Dir(targetDown))
 			}
 		}
+		// repeatable scripts are collected again when they are changed
+		subRepeatable, _ := findRepeatableFiles(subMigDir)
+		for name, repeatablePath := range subRepeatable {
+			if mainPath, ok := mainRepeatable[name]; ok && !sourceChanged(mainPath, repeatablePath) {
+				continue
+			}
+			target := filepath.Join(MigrationDir, name+".repeatable.sql")
+			if err := copyFileWithMeta(repeatablePath, target, meta.withSource(source.Origin(repeatablePath))); err != nil {
+				fmt.Println("Error copying file with meta:", err)
+				continue
+			}
+			collected++
+			copyIncludes(repeatablePath, filepath.Dir(target))
+		}
+		subCallbacks, _ := findCallbackFiles(subMigDir)
+		for name, callbackPath := range subCallbacks {
+			if other, ok := callbackPaths[name]; ok {
+				otherContent, _ := os.ReadFile(other)
+				content, _ := os.ReadFile(callbackPath)
+				if string(otherContent) != string(content) {
+					fmt.Printf("ERROR: callback %s.sql differs in sources %s and %s\n", name, callbackOrigins[name], source.Origin(callbackPath))
+				}
+				continue
+			}
+			callbackPaths[name] = callbackPath
+			callbackOrigins[name] = source.Origin(callbackPath)
+			if mainPath, ok := mainCallbacks[name]; ok && !sourceChanged(mainPath, callbackPath) {
+				continue
+			}
+			target := filepath.Join(MigrationDir, name+".sql")
+			if err := copyFileWithMeta(callbackPath, target, meta.withSource(source.Origin(callbackPath))); err != nil {
+				fmt.Println("Error copying file with meta:", err)
+				continue
+			}
+			collected++
+			copyIncludes(callbackPath, filepath.Dir(target))
+		}
+	}
+
+	closeSources(sources)
+
+	if config.Naming == "order" {
+		for _, key := range sortKeys(collectedKeys, nil) {
+			if err := appendOrder(MigrationDir, key); err != nil {
+				fmt.Printf("Error updating %s: %v\n", OrderFile, err)
+				os.Exit(1)
+			}
+		}
 	}
 
 	if collected > 0 {
@@ -267,79 +970,278 @@ func collect() {
 		fmt.Println("[ok] nothing to collect")
 	}
 	// fmt.Printf("Время выполнения collect: %v\n", time.Since(t0))
+	if err := writeLock(signKey); err != nil {
+		fmt.Println("Error writing lock file:", err)
+		os.Exit(1)
+	}
 	// validation after collecting
-	check()
+	check(checkOptions{filter: &filter})
+}
+
+// reports if source of repeatable or callback script differs from its catalog copy
+func sourceChanged(mainPath, sourcePath string) bool {
+	mainContent, err := os.ReadFile(mainPath)
+	if err != nil {
+		return true
+	}
+	sourceContent, err := os.ReadFile(sourcePath)
+	if err != nil {
+		return false
+	}
+	return bodyChecksum(mainContent) != contentChecksum("sha256", sourceContent)
 }
 
-// copies file and adds metainfo about its origin
-func copyFileWithMeta(src, dst, metaSrc string) error {
+// copies file and adds metainfo about its origin, checksum and collect time are set here
+func copyFileWithMeta(src, dst string, meta migrationMeta) error {
 	input, err := os.ReadFile(src)
 	if err != nil {
 		return err
 	}
 	// add info in the beginning
-	meta := fmt.Sprintf("#migration: %s;%s\n", metaSrc, fileMD5(src))
-	output := append([]byte(meta), input...)
+	meta.algorithm = "sha256"
+	meta.checksum = contentChecksum("sha256", input)
+	meta.collected = time.Now().UTC().Format(time.RFC3339)
+	output := append([]byte(meta.String()+"\n"), input...)
 	return os.WriteFile(dst, output, 0644)
 }
 
-func fileMD5(path string) string {
-	f, err := os.Open(path)
-	if err != nil {
-		return ""
-	}
-	defer f.Close()
-	h := md5.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return ""
+// returns hex checksum of content with md5 (v1 headers) or sha256 algorithm
+func contentChecksum(algorithm string, content []byte) string {
+	if algorithm == "md5" {
+		return fmt.Sprintf("%x", md5.Sum(content))
 	}
-	return fmt.Sprintf("%x", h.Sum(nil))
+	return fmt.Sprintf("%x", sha256.Sum256(content))
 }
 
-// copies include-files, if there are no in the targetDir
-func copyIncludes(sqlFile, targetDir string) {
-	includes, _ := findIncludes(sqlFile, nil)
-	for _, inc := range includes {
-		incSrc := filepath.Join(filepath.Dir(sqlFile), inc)
-		incDst := filepath.Join(targetDir, inc)
-		if _, err := os.Stat(incDst); os.IsNotExist(err) {
-			os.MkdirAll(filepath.Dir(incDst), 0755)
-			input, err := os.ReadFile(incSrc)
-			if err == nil {
-				os.WriteFile(incDst, input, 0644)
+// rewrites v1 meta headers of catalog files to v2, checksum is taken from file body,
+// files with body not matching recorded md5 are reported and left as is
+func upgradeMeta() {
+	mainUp, mainDown, err := findMigrationFiles(MigrationDir)
+	if err != nil {
+		fmt.Println("Error finding migration files:", err)
+		os.Exit(1)
+	}
+	submodules, _ := getSubmodules()
+	upgraded := 0
+	failed := 0
+	for _, files := range []map[string]string{mainUp, mainDown} {
+		for _, file := range files {
+			content, err := os.ReadFile(file)
+			if err != nil {
+				fmt.Println("ERROR:", err)
+				failed++
+				continue
+			}
+			header, body := splitMigrationMeta(string(content))
+			if !strings.HasPrefix(header, "#migration:") {
+				continue
+			}
+			meta := parseMigrationMetaContent(header)
+			if meta.version != 1 {
+				fmt.Printf("ERROR: %s wrong meta header %s\n", file, header)
+				failed++
+				continue
+			}
+			if contentChecksum("md5", []byte(body)) != meta.checksum {
+				fmt.Printf("ERROR: %s body does not match recorded md5 %s, not upgraded\n", file, meta.checksum)
+				failed++
+				continue
+			}
+			meta.version = 2
+			meta.algorithm = "sha256"
+			meta.checksum = contentChecksum("sha256", []byte(body))
+			for _, sub := range submodules {
+				if strings.HasPrefix(filepath.ToSlash(meta.source), filepath.ToSlash(sub)+"/") {
+					meta.submodule = sub
+				}
+			}
+			if err := os.WriteFile(file, []byte(meta.String()+"\n"+body), 0644); err != nil {
+				fmt.Println("ERROR:", err)
+				failed++
+				continue
 			}
+			upgraded++
 		}
 	}
+	if failed > 0 {
+		fmt.Printf("ERROR: %d file(s) not upgraded\n", failed)
+		os.Exit(1)
+	}
+	fmt.Printf("[ok] upgraded %d file(s)\n", upgraded)
 }
 
-func check() {
-	// t0 := time.Now()
-	var errors []string
-	errCh := make(chan string, 10000)
-	wrongFiles := 0
-
-	// main
-	errs, wrong := validateMigrationFilenames(MigrationDir)
-	for _, e := range errs {
-		errCh <- e
+// reads file recorded as migration source, archive members are recorded as archive.tar.gz:member
+func readOrigin(origin string) ([]byte, error) {
+	if archive, member, ok := strings.Cut(origin, ".tar.gz:"); ok {
+		return readTarGzMember(archive+".tar.gz", member)
 	}
-	wrongFiles += wrong
-	mainUp, mainDown, err := findMigrationFiles(MigrationDir)
+	return os.ReadFile(origin)
+}
+
+func readTarGzMember(archive, member string) ([]byte, error) {
+	f, err := os.Open(archive)
 	if err != nil {
-		errCh <- fmt.Sprintf("Error finding migration files: %v", err)
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s not found in %s: %w", member, archive, os.ErrNotExist)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if path.Clean(header.Name) == path.Clean(member) {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+// verifies that catalog files match checksums recorded in their headers and that sources did not change
+func verify() {
+	mainUp, mainDown, err := findMigrationFiles(MigrationDir)
+	if err != nil {
+		fmt.Println("Error finding migration files:", err)
+		os.Exit(1)
+	}
+	mainRepeatable, err := findRepeatableFiles(MigrationDir)
+	if err != nil {
+		fmt.Println("Error finding repeatable files:", err)
+		os.Exit(1)
+	}
+	mainCallbacks, err := findCallbackFiles(MigrationDir)
+	if err != nil {
+		fmt.Println("Error finding callback files:", err)
+		os.Exit(1)
+	}
+	var edited, drifted, missing []string
+	for _, files := range []map[string]string{mainUp, mainDown, mainRepeatable, mainCallbacks} {
+		for _, file := range files {
+			content, err := os.ReadFile(file)
+			if err != nil {
+				fmt.Println("ERROR:", err)
+				os.Exit(1)
+			}
+			header, body := splitMigrationMeta(string(content))
+			if header == "" {
+				continue
+			}
+			meta := parseMigrationMetaContent(header)
+			if meta.checksum != "" && contentChecksum(meta.algorithm, []byte(body)) != meta.checksum {
+				edited = append(edited, file)
+			}
+			if meta.source == "" || meta.origin != "" {
+				continue
+			}
+			source, err := readOrigin(meta.source)
+			if errors.Is(err, os.ErrNotExist) {
+				missing = append(missing, fmt.Sprintf("%s -> %s", file, meta.source))
+				continue
+			}
+			if err != nil {
+				fmt.Println("ERROR:", err)
+				os.Exit(1)
+			}
+			if meta.checksum != "" && contentChecksum(meta.algorithm, source) != meta.checksum {
+				drifted = append(drifted, fmt.Sprintf("%s -> %s", file, meta.source))
+			}
+		}
+	}
+	findings := []struct {
+		title string
+		files []string
+	}{
+		{"catalog files edited after collect (body does not match header checksum):", edited},
+		{"sources changed after collect (source does not match header checksum):", drifted},
+		{"headers pointing to nonexistent sources:", missing},
+	}
+	failed := false
+	for _, finding := range findings {
+		if len(finding.files) == 0 {
+			continue
+		}
+		failed = true
+		sort.Strings(finding.files)
+		fmt.Println(finding.title)
+		for _, f := range finding.files {
+			fmt.Println("  ", f)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+	fmt.Println("[ok] Migrations checksums are correct.")
+}
+
+// copies include-files, if there are no in the targetDir
+func copyIncludes(sqlFile, targetDir string) {
+	includes, _ := findIncludes(sqlFile, nil)
+	for _, inc := range includes {
+		incSrc := filepath.Join(filepath.Dir(sqlFile), inc)
+		incDst := filepath.Join(targetDir, inc)
+		if _, err := os.Stat(incDst); os.IsNotExist(err) {
+			os.MkdirAll(filepath.Dir(incDst), 0755)
+			input, err := os.ReadFile(incSrc)
+			if err == nil {
+				os.WriteFile(incDst, input, 0644)
+			}
+		}
+	}
+}
+
+// checkOptions are check command flags
+type checkOptions struct {
+	filter     *sourceFilter
+	locked     bool
+	verifyKey  string
+	allowAmend listFlag
+	reason     string
+}
+
+func check(opts checkOptions) {
+	// t0 := time.Now()
+	var errors []string
+	errCh := make(chan string, 10000)
+	wrongFiles := 0
+
+	// main
+	errs, wrong := validateMigrationFilenames(MigrationDir)
+	for _, e := range errs {
+		errCh <- e
+	}
+	wrongFiles += wrong
+	mainUp, mainDown, err := findMigrationFiles(MigrationDir)
+	if err != nil {
+		errCh <- fmt.Sprintf("Error finding migration files: %v", err)
 	}
+	mainRepeatable, _ := findRepeatableFiles(MigrationDir)
+	mainCallbacks, _ := findCallbackFiles(MigrationDir)
+	// callback origins by name, callback of same name must not differ between sources
+	callbackOrigins := make(map[string]string)
 
-	// submodules
-	submodules, err := getSubmodules()
+	// submodules and other sources
+	sources, skipped, err := getSources(*opts.filter)
 	if err != nil {
-		errCh <- fmt.Sprintf("Error getting submodules: %v", err)
+		errCh <- fmt.Sprintf("Error getting sources: %v", err)
 	}
+	printSkipped(skipped)
 	missed := []string{}
-	for _, sub := range submodules {
-		if _, err := findDescribeScript(sub); err != nil {
+	for _, source := range sources {
+		for _, e := range source.Validate() {
+			errCh <- e
+		}
+		subMigDir, err := source.Dir()
+		if err != nil {
 			errCh <- fmt.Sprintf("ERROR: %v", err)
+			continue
 		}
-		subMigDir := filepath.Join(sub, "migrations")
 		errs, wrong := validateMigrationFilenames(subMigDir)
 		for _, e := range errs {
 			errCh <- e
@@ -349,29 +1251,56 @@ func check() {
 		subUp, subDown, _ := findMigrationFiles(subMigDir)
 		for key, upPath := range subUp {
 			if _, ok := mainUp[key]; !ok {
-				missed = append(missed, upPath)
+				missed = append(missed, source.Origin(upPath))
 			}
 			if mainPath, ok := mainUp[key]; ok {
-				_, mainMD5 := parseMigrationMeta(mainPath)
-				_, subMD5 := parseMigrationMeta(upPath)
-				if mainMD5 != "" && subMD5 != "" && mainMD5 != subMD5 {
-					errCh <- fmt.Sprintf("ERROR: migration meta mismatch for %s: main md5=%s, submodule md5=%s", key+".up.sql", mainMD5, subMD5)
+				mainMeta := parseMigrationMeta(mainPath)
+				subMeta := parseMigrationMeta(upPath)
+				if mainMeta.checksum != "" && subMeta.checksum != "" && mainMeta.algorithm == subMeta.algorithm && mainMeta.checksum != subMeta.checksum {
+					errCh <- fmt.Sprintf("ERROR: migration meta mismatch for %s: main %s=%s, submodule %s=%s", key+".up.sql", mainMeta.algorithm, mainMeta.checksum, subMeta.algorithm, subMeta.checksum)
 				}
 			}
 		}
 		for key, downPath := range subDown {
 			if _, ok := mainDown[key]; !ok {
-				missed = append(missed, downPath)
+				missed = append(missed, source.Origin(downPath))
 			}
 			if mainPath, ok := mainDown[key]; ok {
-				_, mainMD5 := parseMigrationMeta(mainPath)
-				_, subMD5 := parseMigrationMeta(downPath)
-				if mainMD5 != "" && subMD5 != "" && mainMD5 != subMD5 {
-					errCh <- fmt.Sprintf("ERROR: migration meta mismatch for %s: main md5=%s, submodule md5=%s", key+".down.sql", mainMD5, subMD5)
+				mainMeta := parseMigrationMeta(mainPath)
+				subMeta := parseMigrationMeta(downPath)
+				if mainMeta.checksum != "" && subMeta.checksum != "" && mainMeta.algorithm == subMeta.algorithm && mainMeta.checksum != subMeta.checksum {
+					errCh <- fmt.Sprintf("ERROR: migration meta mismatch for %s: main %s=%s, submodule %s=%s", key+".down.sql", mainMeta.algorithm, mainMeta.checksum, subMeta.algorithm, subMeta.checksum)
+				}
+			}
+		}
+		subRepeatable, _ := findRepeatableFiles(subMigDir)
+		for name, repeatablePath := range subRepeatable {
+			if mainPath, ok := mainRepeatable[name]; !ok || sourceChanged(mainPath, repeatablePath) {
+				missed = append(missed, source.Origin(repeatablePath))
+			}
+		}
+		subCallbacks, _ := findCallbackFiles(subMigDir)
+		for name, callbackPath := range subCallbacks {
+			if other, ok := callbackOrigins[name]; ok {
+				otherContent, _ := readOrigin(other)
+				content, _ := os.ReadFile(callbackPath)
+				if string(otherContent) != string(content) {
+					errCh <- fmt.Sprintf("ERROR: callback %s.sql differs in sources %s and %s", name, other, source.Origin(callbackPath))
 				}
+				continue
+			}
+			callbackOrigins[name] = source.Origin(callbackPath)
+			if mainPath, ok := mainCallbacks[name]; !ok || sourceChanged(mainPath, callbackPath) {
+				missed = append(missed, source.Origin(callbackPath))
+			}
+		}
+		if sub, ok := source.(*submoduleSource); ok {
+			for _, e := range checkSubmoduleCommits(sub, mainUp, mainDown) {
+				errCh <- e
 			}
 		}
 	}
+	closeSources(sources)
 
 	// check having a piar up - down.sql
 	wrongPairs := make([]string, 0, len(mainUp)+len(mainDown))
@@ -404,7 +1333,7 @@ func check() {
 	// check include files
 	missingIncludes := []string{}
 	incWg := sync.WaitGroup{}
-	incCh := make(chan string, len(mainUp)+len(mainDown))
+	incCh := make(chan string, len(mainUp)+len(mainDown)+len(mainRepeatable)+len(mainCallbacks))
 	for _, upPath := range mainUp {
 		incWg.Add(1)
 		go func(upPath string) {
@@ -414,7 +1343,6 @@ func check() {
 				incPath := filepath.Join(filepath.Dir(upPath), inc)
 				if _, err := os.Stat(incPath); os.IsNotExist(err) {
 					incCh <- incPath
-					wrongFiles++
 				}
 			}
 		}(upPath)
@@ -428,16 +1356,63 @@ func check() {
 				incPath := filepath.Join(filepath.Dir(downPath), inc)
 				if _, err := os.Stat(incPath); os.IsNotExist(err) {
 					incCh <- incPath
-					wrongFiles++
 				}
 			}
 		}(downPath)
 	}
+	for _, files := range []map[string]string{mainRepeatable, mainCallbacks} {
+		for _, file := range files {
+			incWg.Add(1)
+			go func(file string) {
+				defer incWg.Done()
+				includes, _ := findIncludes(file, nil)
+				for _, inc := range includes {
+					incPath := filepath.Join(filepath.Dir(file), inc)
+					if _, err := os.Stat(incPath); os.IsNotExist(err) {
+						incCh <- incPath
+					}
+				}
+			}(file)
+		}
+	}
 	incWg.Wait()
 	close(incCh)
 	for inc := range incCh {
 		missingIncludes = append(missingIncludes, inc)
 	}
+	// counted here, goroutines only send missing includes
+	wrongFiles += len(missingIncludes)
+
+	noEffect := checkNoEffect(mainUp, mainDown)
+	conflicts := findNumberConflicts(mainUp, mainDown)
+	config, err := loadConfig()
+	if err != nil {
+		errCh <- fmt.Sprintf("ERROR: %v", err)
+	}
+	for _, e := range checkOrder(MigrationDir, mainUp, mainDown, config) {
+		errCh <- e
+	}
+	for key := range goMigrations {
+		_, hasUp := mainUp[key]
+		_, hasDown := mainDown[key]
+		if hasUp || hasDown {
+			errCh <- fmt.Sprintf("ERROR: %s is registered as Go migration and has SQL scripts", key)
+		}
+	}
+	sequenceErrs, sequenceWarns := checkSequence(mainUp, mainDown, config)
+	if len(opts.allowAmend) > 0 {
+		if err := amendReleased(opts.allowAmend, opts.reason, mainUp, mainDown); err != nil {
+			errCh <- fmt.Sprintf("ERROR: %v", err)
+		}
+	}
+	releasedErrs, releasedWarns := checkReleased(mainUp, mainDown, config)
+	transactionErrs, transactionWarns := checkTransactions([]map[string]string{mainUp, mainDown, mainRepeatable, mainCallbacks}, config)
+
+	if opts.locked {
+		for _, e := range checkLock("", opts.verifyKey) {
+			errCh <- e
+		}
+	}
 
 	close(errCh)
 	for e := range errCh {
@@ -480,6 +1455,46 @@ func check() {
 		// fmt.Printf("Время выполнения check: %v\n", time.Since(t0))
 		os.Exit(1)
 	}
+	if len(conflicts) > 0 {
+		fmt.Println("migration number conflicts:")
+		for _, c := range conflicts {
+			fmt.Println("  ", c)
+		}
+		fmt.Println("use: scripts/migration.go renumber")
+		os.Exit(1)
+	}
+	for _, w := range append(append(sequenceWarns, releasedWarns...), transactionWarns...) {
+		fmt.Println("WARNING:", w)
+	}
+	if len(releasedErrs) > 0 {
+		fmt.Println("released migrations changed:")
+		for _, e := range releasedErrs {
+			fmt.Println("  ", e)
+		}
+		fmt.Println("use: scripts/migration.go check --allow-amend <key> --reason <text>")
+		os.Exit(1)
+	}
+	if len(sequenceErrs) > 0 {
+		fmt.Println("migration numbering problems:")
+		for _, e := range sequenceErrs {
+			fmt.Println("  ", e)
+		}
+		os.Exit(1)
+	}
+	if len(transactionErrs) > 0 {
+		fmt.Println("transaction problems:")
+		for _, e := range transactionErrs {
+			fmt.Println("  ", e)
+		}
+		os.Exit(1)
+	}
+	if len(noEffect) > 0 {
+		fmt.Println("migrations without effect (add #noop line to mark intentional):")
+		for _, n := range noEffect {
+			fmt.Println("  ", n)
+		}
+		os.Exit(1)
+	}
 	fmt.Println("[ok] Migrations are correct. No unregistered found.")
 	// fmt.Printf("Время выполнения check: %v\n", time.Since(t0))
 }
@@ -501,123 +1516,4351 @@ func getSubmodules() ([]string, error) {
 	return submodules, nil
 }
 
-func findMigrationFiles(root string) (map[string]string, map[string]string, error) {
-	upFiles := make(map[string]string)
-	downFiles := make(map[string]string) //  key: clean name; value: path
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
-		}
-		if strings.HasSuffix(info.Name(), ".up.sql") {
-			key := strings.TrimSuffix(info.Name(), ".up.sql")
-			upFiles[key] = path
-		} else if strings.HasSuffix(info.Name(), ".down.sql") {
-			key := strings.TrimSuffix(info.Name(), ".down.sql")
-			downFiles[key] = path
-		}
-		return nil
-	})
-	if err != nil {
-		return nil, nil, err
+// Config is a tool configuration read from ConfigPath, all fields are optional
+type Config struct {
+	Sources []SourceConfig `json:"sources"`
+	// Only and Exclude are globs of source names, see sourceFilter
+	Only    []string `json:"only"`
+	Exclude []string `json:"exclude"`
+	// SignKey and VerifyKey are ed25519 PEM key files for LockPath, see writeLock and checkLock
+	SignKey   string `json:"sign_key"`
+	VerifyKey string `json:"verify_key"`
+	// Rules sets policy of numbering rules, see checkSequence
+	Rules map[string]string `json:"rules"`
+	// Naming is a strategy of add: counter, timestamp or order
+	Naming string `json:"naming"`
+	// HistoryTable is a table of applied migrations, HistoryTable by default
+	HistoryTable string `json:"history_table"`
+	// Driver and DSN are database/sql driver name and data source of apply, rollback and status
+	Driver string `json:"driver"`
+	DSN    string `json:"dsn"`
+	// Dialect is postgres, mysql, oracle or sqlite, see checkTransactions and splitStatements
+	Dialect string `json:"dialect"`
+	// LockTTL is duration of lock row of apply and rollback, LockTTL by default, see acquireLock
+	LockTTL string `json:"lock_ttl"`
+}
+
+func (c Config) historyTable() string {
+	if c.HistoryTable != "" {
+		return c.HistoryTable
 	}
-	return upFiles, downFiles, nil
+	return HistoryTable
 }
 
-func findDescribeScript(submodulePath string) (string, error) {
-	paths := []string{
-		filepath.Join(submodulePath, "describe.sh"),
-		filepath.Join(submodulePath, "scripts", "describe.sh"),
+// policy of rule, error by default
+// defaultPolicies are policies of rules which are not errors by default,
+// keys of new migrations of released version are added after release with tag versioning of describe.sh
+var defaultPolicies = map[string]string{"added-after-release": "warning"}
+
+func (c Config) policy(rule string) string {
+	switch p := c.Rules[rule]; p {
+	case "error", "warning", "off":
+		return p
 	}
-	for _, p := range paths {
-		if _, err := os.Stat(p); err == nil {
-			return p, nil
-		}
+	if p, ok := defaultPolicies[rule]; ok {
+		return p
 	}
-	return "", fmt.Errorf("submodule %s has no describe script", submodulePath)
+	return "error"
 }
 
-func validateMigrationFilenames(dir string) ([]string, int) {
-	entries, err := os.ReadDir(dir)
+// SourceConfig describes one migrations source
+//
+//	{"type": "submodules"}                          all git submodules (default)
+//	{"type": "dir", "path": "vendor/billing"}       directory or git worktree with migrations subdirectory
+//	{"type": "tar", "path": "vendor/billing.tar.gz"} archive with migrations subdirectory
+type SourceConfig struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+	// Migrations is a migrations subdirectory name, default is "migrations"
+	Migrations string `json:"migrations"`
+}
+
+func loadConfig() (Config, error) {
+	config := Config{}
+	content, err := os.ReadFile(ConfigPath)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
 	if err != nil {
-		if os.IsNotExist((err)) {
-			return nil, 0
-		}
-		return []string{fmt.Sprintf("ERROR: failed to read dir %s: %v", dir, err)}, 0
+		return config, fmt.Errorf("failed to read config %s: %v", ConfigPath, err)
 	}
-	var errs []string
-	count := 0
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-		name := entry.Name()
-		if !strings.HasSuffix(name, ".up.sql") && !strings.HasSuffix(name, ".down.sql") {
-			errs = append(errs, fmt.Sprintf("ERROR: %s wrong file name suffix expect .up.sql or .down.sql", name))
-			count++
+	if err := json.Unmarshal(content, &config); err != nil {
+		return config, fmt.Errorf("failed to parse config %s: %v", ConfigPath, err)
+	}
+	return config, nil
+}
+
+// loadConfigAt reads ConfigPath of commit, it works on bare repository
+func loadConfigAt(ref string) (Config, error) {
+	config := Config{}
+	object := ref + ":" + path.Clean(filepath.ToSlash(ConfigPath))
+	if _, err := runGit("cat-file", "-e", object); err != nil {
+		return config, nil
+	}
+	content, err := runGit("show", object)
+	if err != nil {
+		return config, fmt.Errorf("failed to read config %s: %v", object, err)
+	}
+	if err := json.Unmarshal(content, &config); err != nil {
+		return config, fmt.Errorf("failed to parse config %s: %v", object, err)
+	}
+	return config, nil
+}
+
+// Source is a component which provides migrations and include files for collect and check
+type Source interface {
+	// Name identifies source in reports
+	Name() string
+	// Dir returns local directory with migrations and include files of source
+	Dir() (string, error)
+	// Origin returns path of file from Dir to be recorded in migration meta
+	Origin(file string) string
+	// Validate returns errors about source itself
+	Validate() []string
+	// Commit returns commit of source files, empty if source is not versioned
+	Commit() string
+	Close() error
+}
+
+// sourceFilter selects sources by name globs, e.g. submodules/submodule2 or submodules/*
+type sourceFilter struct {
+	only    listFlag
+	exclude listFlag
+}
+
+// listFlag is a flag which could be repeated or set as comma separated list
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
 		}
 	}
-	return errs, count
+	return nil
 }
 
-func findIncludes(filePath string, visited map[string]struct{}) ([]string, error) {
-	includes := []string{}
-	if visited == nil {
-		visited = make(map[string]struct{})
+func sourceFlags(fs *flag.FlagSet) *sourceFilter {
+	filter := &sourceFilter{}
+	fs.Var(&filter.only, "only", "use only sources matching glob")
+	fs.Var(&filter.exclude, "exclude", "skip sources matching glob")
+	return filter
+}
+
+// command line --only replaces config one, --exclude is added to config one
+func (f sourceFilter) merge(config Config) sourceFilter {
+	merged := sourceFilter{only: f.only, exclude: append(listFlag{}, config.Exclude...)}
+	if len(merged.only) == 0 {
+		merged.only = config.Only
 	}
-	if _, ok := visited[filePath]; ok {
-		return includes, nil
+	merged.exclude = append(merged.exclude, f.exclude...)
+	return merged
+}
+
+func (f sourceFilter) match(name string) bool {
+	name = path.Clean(filepath.ToSlash(name))
+	for _, pattern := range f.exclude {
+		if ok, _ := path.Match(pattern, name); ok {
+			return false
+		}
 	}
-	visited[filePath] = struct{}{}
-	content, err := os.ReadFile(filePath)
-	if err != nil {
-		return nil, err
+	if len(f.only) == 0 {
+		return true
 	}
-	lines := strings.Split(string(content), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "@") {
-			inc := strings.TrimPrefix(line, "@")
-			inc = strings.Split(inc, ";")[0] // убрать ; если есть
-			inc = strings.TrimSpace(inc)
-			if inc != "" {
-				if !strings.HasSuffix(inc, ".sql") {
-					fmt.Printf("ERROR:   wrong include @%s in %s\n", inc, filePath)
-					continue
-				}
-				incPath := filepath.Join(filepath.Dir(filePath), inc)
-				if _, err := os.Stat(incPath); os.IsNotExist(err) {
-					fmt.Printf("ERROR:   wrong include @%s in %s\n", inc, filePath)
-					continue
-				}
-				includes = append(includes, inc)
-				recInc, _ := findIncludes(incPath, visited)
-				includes = append(includes, recInc...)
-			}
+	for _, pattern := range f.only {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
 		}
 	}
-	return includes, nil
+	return false
 }
 
-func parseMigrationMeta(filePath string) (string, string) {
-	content, err := os.ReadFile(filePath)
+func printSkipped(skipped []string) {
+	for _, name := range skipped {
+		fmt.Println("skipped source", name)
+	}
+}
+
+// getSources returns configured sources, git submodules if nothing is configured,
+// and names of sources skipped by filter
+func getSources(filter sourceFilter) ([]Source, []string, error) {
+	config, err := loadConfig()
 	if err != nil {
-		return "", ""
+		return nil, nil, err
 	}
-	lines := strings.Split(string(content), "\n")
-	for _, line := range lines {
-		if strings.HasPrefix(line, "#migration:") {
-			parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
-			if len(parts) == 2 {
-				meta := strings.TrimSpace(parts[1])
-				metaParts := strings.Split(meta, ";")
-				if len(metaParts) == 2 {
-					return metaParts[0], metaParts[1]
-				}
+	filter = filter.merge(config)
+	sourceConfigs := config.Sources
+	if len(sourceConfigs) == 0 {
+		sourceConfigs = []SourceConfig{{Type: "submodules"}}
+	}
+	sources := []Source{}
+	for _, sc := range sourceConfigs {
+		migrations := sc.Migrations
+		if migrations == "" {
+			migrations = "migrations"
+		}
+		switch sc.Type {
+		case "submodules":
+			submodules, err := getSubmodules()
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, sub := range submodules {
+				sources = append(sources, &submoduleSource{path: sub, migrations: migrations})
 			}
+		case "dir":
+			sources = append(sources, &dirSource{path: sc.Path, migrations: migrations})
+		case "tar":
+			sources = append(sources, &tarSource{path: sc.Path, migrations: migrations})
+		default:
+			return nil, nil, fmt.Errorf("unknown source type '%s' in %s", sc.Type, ConfigPath)
+		}
+	}
+	selected := []Source{}
+	skipped := []string{}
+	for _, source := range sources {
+		if filter.match(source.Name()) {
+			selected = append(selected, source)
+		} else {
+			skipped = append(skipped, source.Name())
+		}
+	}
+	return selected, skipped, nil
+}
+
+func closeSources(sources []Source) {
+	for _, source := range sources {
+		if err := source.Close(); err != nil {
+			fmt.Println("Error closing source:", err)
 		}
 	}
-	return "", ""
+}
+
+type submoduleSource struct {
+	path       string
+	migrations string
+}
+
+func (s *submoduleSource) Name() string { return s.path }
+
+func (s *submoduleSource) Dir() (string, error) { return filepath.Join(s.path, s.migrations), nil }
+
+func (s *submoduleSource) Origin(file string) string { return file }
+
+func (s *submoduleSource) Validate() []string {
+	if _, err := findDescribeScript(s.path); err != nil {
+		return []string{fmt.Sprintf("ERROR: %v", err)}
+	}
+	return nil
+}
+
+func (s *submoduleSource) Commit() string {
+	output, err := runGit("-C", s.path, "rev-parse", "HEAD")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// gitlink returns submodule commit recorded in superproject index
+func (s *submoduleSource) gitlink() (string, error) {
+	output, err := runGit("rev-parse", ":"+filepath.ToSlash(s.path))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (s *submoduleSource) Close() error { return nil }
+
+// dirSource is a plain directory or git worktree
+type dirSource struct {
+	path       string
+	migrations string
+}
+
+func (s *dirSource) Name() string { return s.path }
+
+func (s *dirSource) Dir() (string, error) { return filepath.Join(s.path, s.migrations), nil }
+
+func (s *dirSource) Origin(file string) string { return file }
+
+func (s *dirSource) Validate() []string {
+	if info, err := os.Stat(s.path); err != nil || !info.IsDir() {
+		return []string{fmt.Sprintf("ERROR: source directory %s not found", s.path)}
+	}
+	return nil
+}
+
+func (s *dirSource) Commit() string { return "" }
+
+func (s *dirSource) Close() error { return nil }
+
+// tarSource is a .tar.gz archive, it is extracted to temporary directory on first use
+type tarSource struct {
+	path       string
+	migrations string
+	tmp        string
+}
+
+func (s *tarSource) Name() string { return s.path }
+
+func (s *tarSource) Dir() (string, error) {
+	if s.tmp == "" {
+		tmp, err := os.MkdirTemp("", "migration-source-")
+		if err != nil {
+			return "", err
+		}
+		s.tmp = tmp
+		if err := extractTarGz(s.path, tmp); err != nil {
+			return "", fmt.Errorf("failed to extract %s: %v", s.path, err)
+		}
+	}
+	return filepath.Join(s.tmp, s.migrations), nil
+}
+
+// archive members are recorded as archive.tar.gz:member
+func (s *tarSource) Origin(file string) string {
+	rel, err := filepath.Rel(s.tmp, file)
+	if err != nil {
+		return file
+	}
+	return s.path + ":" + filepath.ToSlash(rel)
+}
+
+func (s *tarSource) Validate() []string {
+	if _, err := os.Stat(s.path); err != nil {
+		return []string{fmt.Sprintf("ERROR: source archive %s not found", s.path)}
+	}
+	return nil
+}
+
+func (s *tarSource) Commit() string { return "" }
+
+func (s *tarSource) Close() error {
+	if s.tmp == "" {
+		return nil
+	}
+	return os.RemoveAll(s.tmp)
+}
+
+func extractTarGz(archive, targetDir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("wrong archive member %s", header.Name)
+		}
+		target := filepath.Join(targetDir, name)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func findMigrationFiles(root string) (map[string]string, map[string]string, error) {
+	upFiles := make(map[string]string)
+	downFiles := make(map[string]string) //  key: clean name; value: path
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(info.Name(), ".up.sql") {
+			key := strings.TrimSuffix(info.Name(), ".up.sql")
+			upFiles[key] = path
+		} else if strings.HasSuffix(info.Name(), ".down.sql") {
+			key := strings.TrimSuffix(info.Name(), ".down.sql")
+			downFiles[key] = path
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return upFiles, downFiles, nil
+}
+
+// findRepeatableFiles returns <name>.repeatable.sql files by name
+func findRepeatableFiles(root string) (map[string]string, error) {
+	files := make(map[string]string)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".repeatable.sql") {
+			files[strings.TrimSuffix(info.Name(), ".repeatable.sql")] = path
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// callback events of bundle up (migrate) and down (rollback) scripts
+var callbackEvents = []string{
+	"beforeMigrate", "beforeEachMigrate", "afterEachMigrate", "afterMigrate",
+	"beforeRollback", "beforeEachRollback", "afterEachRollback", "afterRollback",
+}
+
+var callbackPattern = regexp.MustCompile(`^(` + strings.Join(callbackEvents, "|") + `)(__.+)?\.sql$`)
+
+// findCallbackFiles returns callback files by name without .sql
+func findCallbackFiles(root string) (map[string]string, error) {
+	files := make(map[string]string)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && callbackPattern.MatchString(info.Name()) {
+			files[strings.TrimSuffix(info.Name(), ".sql")] = path
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// callbackFiles returns files of event callbacks in name order
+func callbackFiles(callbacks map[string]string, event string) []string {
+	var names []string
+	for name := range callbacks {
+		if matches := callbackPattern.FindStringSubmatch(name + ".sql"); matches != nil && matches[1] == event {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	files := make([]string, 0, len(names))
+	for _, name := range names {
+		files = append(files, callbacks[name])
+	}
+	return files
+}
+
+// bodyChecksum is sha256 of script without meta header, so collecting same script again does not rerun it
+func bodyChecksum(content []byte) string {
+	_, body := splitMigrationMeta(string(content))
+	return contentChecksum("sha256", []byte(body))
+}
+
+func findDescribeScript(submodulePath string) (string, error) {
+	paths := []string{
+		filepath.Join(submodulePath, "describe.sh"),
+		filepath.Join(submodulePath, "scripts", "describe.sh"),
+	}
+	for _, p := range paths {
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("submodule %s has no describe script", submodulePath)
+}
+
+func validateMigrationFilenames(dir string) ([]string, int) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist((err)) {
+			return nil, 0
+		}
+		return []string{fmt.Sprintf("ERROR: failed to read dir %s: %v", dir, err)}, 0
+	}
+	var errs []string
+	count := 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		if name == OrderFile {
+			continue
+		}
+		if !strings.HasSuffix(name, ".up.sql") && !strings.HasSuffix(name, ".down.sql") && !strings.HasSuffix(name, ".repeatable.sql") && !callbackPattern.MatchString(name) {
+			errs = append(errs, fmt.Sprintf("ERROR: %s wrong file name suffix expect .up.sql, .down.sql, .repeatable.sql or callback name", name))
+			count++
+		}
+	}
+	return errs, count
+}
+
+func findIncludes(filePath string, visited map[string]struct{}) ([]string, error) {
+	return readIncludes(os.ReadFile, filePath, visited)
+}
+
+// readIncludes is findIncludes with files read by read, includes which can not be read are reported as wrong
+func readIncludes(read func(string) ([]byte, error), filePath string, visited map[string]struct{}) ([]string, error) {
+	includes := []string{}
+	if visited == nil {
+		visited = make(map[string]struct{})
+	}
+	if _, ok := visited[filePath]; ok {
+		return includes, nil
+	}
+	visited[filePath] = struct{}{}
+	content, err := read(filePath)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(content), "\n")
+	for _, line := range lines {
+		if inc, ok := parseIncludeLine(line); ok {
+			if inc != "" {
+				if !strings.HasSuffix(inc, ".sql") {
+					fmt.Printf("ERROR:   wrong include @%s in %s\n", inc, filePath)
+					continue
+				}
+				incPath := filepath.Join(filepath.Dir(filePath), inc)
+				if _, err := read(incPath); errors.Is(err, os.ErrNotExist) {
+					fmt.Printf("ERROR:   wrong include @%s in %s\n", inc, filePath)
+					continue
+				}
+				includes = append(includes, inc)
+				recInc, _ := readIncludes(read, incPath, visited)
+				includes = append(includes, recInc...)
+			}
+		}
+	}
+	return includes, nil
+}
+
+// returns include file name of @include line
+func parseIncludeLine(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "@") {
+		return "", false
+	}
+	inc := strings.TrimPrefix(line, "@")
+	inc = strings.Split(inc, ";")[0] // убрать ; если есть
+	return strings.TrimSpace(inc), true
+}
+
+// migrationMeta is an origin of catalog file written by collect in the first line, current format is
+//
+//	#migration-v2: checksum=sha256:<hex> source=<path> submodule=<name> commit=<sha> collected=<RFC3339>
+//
+// imported migrations have origin=<tool> origin_file=<file name> origin_version=<version> instead of source, submodule and commit,
+// values are escaped with url path escaping, older format is still read
+//
+//	#migration: <source path>;<md5>[;<source commit>]
+type migrationMeta struct {
+	version   int
+	algorithm string
+	checksum  string
+	source    string
+	submodule string
+	commit    string
+	collected string
+	// origin is a tool of imported migration, originFile and originVersion are its file name and version there
+	origin        string
+	originFile    string
+	originVersion string
+}
+
+func (m migrationMeta) withSource(source string) migrationMeta {
+	m.source = source
+	return m
+}
+
+// String formats meta as v2 header line
+func (m migrationMeta) String() string {
+	fields := []string{"#migration-v2:"}
+	add := func(key, value string) {
+		if value != "" {
+			fields = append(fields, key+"="+escapeMetaValue(value))
+		}
+	}
+	if m.checksum != "" {
+		add("checksum", m.algorithm+":"+m.checksum)
+	}
+	add("source", m.source)
+	add("submodule", m.submodule)
+	add("commit", m.commit)
+	add("collected", m.collected)
+	add("origin", m.origin)
+	add("origin_file", m.originFile)
+	add("origin_version", m.originVersion)
+	return strings.Join(fields, " ")
+}
+
+func escapeMetaValue(value string) string {
+	return strings.NewReplacer("%", "%25", " ", "%20", "\t", "%09", "\n", "%0A", "\r", "%0D").Replace(value)
+}
+
+func isMetaLine(line string) bool {
+	return strings.HasPrefix(line, "#migration:") || strings.HasPrefix(line, "#migration-v2:")
+}
+
+// splits catalog file content into meta header line and migration body
+func splitMigrationMeta(content string) (string, string) {
+	line, body, _ := strings.Cut(content, "\n")
+	if isMetaLine(strings.TrimRight(line, "\r")) {
+		return line, body
+	}
+	return "", content
+}
+
+func parseMigrationMeta(filePath string) migrationMeta {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return migrationMeta{}
+	}
+	return parseMigrationMetaContent(string(content))
+}
+
+func parseMigrationMetaContent(content string) migrationMeta {
+	lines := strings.Split(content, "\n")
+	for _, line := range lines {
+		if strings.HasPrefix(line, "#migration-v2:") {
+			return parseMetaV2(strings.TrimSpace(strings.TrimPrefix(line, "#migration-v2:")))
+		}
+		if strings.HasPrefix(line, "#migration:") {
+			return parseMetaV1(strings.TrimSpace(strings.TrimPrefix(line, "#migration:")))
+		}
+	}
+	return migrationMeta{}
+}
+
+var md5Pattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// parseMetaV1 parses source;checksum[;commit] from the right, source may contain ';' itself
+func parseMetaV1(fields string) migrationMeta {
+	parts := strings.Split(fields, ";")
+	n := len(parts)
+	if n >= 3 && md5Pattern.MatchString(parts[n-2]) && !md5Pattern.MatchString(parts[n-1]) {
+		return migrationMeta{version: 1, algorithm: "md5", source: strings.Join(parts[:n-2], ";"), checksum: parts[n-2], commit: parts[n-1]}
+	}
+	if n >= 2 {
+		return migrationMeta{version: 1, algorithm: "md5", source: strings.Join(parts[:n-1], ";"), checksum: parts[n-1]}
+	}
+	return migrationMeta{}
+}
+
+func parseMetaV2(fields string) migrationMeta {
+	meta := migrationMeta{version: 2}
+	for _, field := range strings.Fields(fields) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		if unescaped, err := url.PathUnescape(value); err == nil {
+			value = unescaped
+		}
+		switch key {
+		case "checksum":
+			meta.algorithm, meta.checksum, _ = strings.Cut(value, ":")
+		case "source":
+			meta.source = value
+		case "submodule":
+			meta.submodule = value
+		case "commit":
+			meta.commit = value
+		case "collected":
+			meta.collected = value
+		case "origin":
+			meta.origin = value
+		case "origin_file":
+			meta.originFile = value
+		case "origin_version":
+			meta.originVersion = value
+		}
+	}
+	return meta
+}
+
+// treeEntry is a file or submodule gitlink at commit, as listed by git ls-tree
+type treeEntry struct {
+	mode   string
+	kind   string
+	object string
+	path   string
+}
+
+func runGit(args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v", strings.Join(args, " "), err)
+	}
+	return output, nil
+}
+
+// lists all files and gitlinks of commit tree, key is a slash separated path
+func listTree(ref string, paths ...string) (map[string]treeEntry, error) {
+	args := append([]string{"ls-tree", "-r", "-z", "--full-tree", ref, "--"}, paths...)
+	output, err := runGit(args...)
+	if err != nil {
+		return nil, err
+	}
+	tree := make(map[string]treeEntry)
+	for _, record := range strings.Split(string(output), "\x00") {
+		info, name, ok := strings.Cut(record, "\t")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(info)
+		if len(fields) != 3 {
+			continue
+		}
+		tree[name] = treeEntry{mode: fields[0], kind: fields[1], object: fields[2], path: name}
+	}
+	return tree, nil
+}
+
+func readBlob(object string) (string, error) {
+	output, err := runGit("cat-file", "blob", object)
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
+
+// tree analogue of findMigrationFiles, looks only at files inside dir
+func findTreeMigrationFiles(tree map[string]treeEntry, dir string) (map[string]treeEntry, map[string]treeEntry) {
+	upFiles := make(map[string]treeEntry)
+	downFiles := make(map[string]treeEntry)
+	for name, entry := range tree {
+		if entry.kind != "blob" || !strings.HasPrefix(name, dir+"/") {
+			continue
+		}
+		base := path.Base(name)
+		if strings.HasSuffix(base, ".up.sql") {
+			upFiles[strings.TrimSuffix(base, ".up.sql")] = entry
+		} else if strings.HasSuffix(base, ".down.sql") {
+			downFiles[strings.TrimSuffix(base, ".down.sql")] = entry
+		}
+	}
+	return upFiles, downFiles
+}
+
+// tree analogue of findRepeatableFiles
+func findTreeRepeatableFiles(tree map[string]treeEntry, dir string) map[string]treeEntry {
+	files := make(map[string]treeEntry)
+	for name, entry := range tree {
+		base := path.Base(name)
+		if entry.kind == "blob" && strings.HasPrefix(name, dir+"/") && strings.HasSuffix(base, ".repeatable.sql") {
+			files[strings.TrimSuffix(base, ".repeatable.sql")] = entry
+		}
+	}
+	return files
+}
+
+// tree analogue of findCallbackFiles
+func findTreeCallbackFiles(tree map[string]treeEntry, dir string) map[string]treeEntry {
+	files := make(map[string]treeEntry)
+	for name, entry := range tree {
+		base := path.Base(name)
+		if entry.kind == "blob" && strings.HasPrefix(name, dir+"/") && callbackPattern.MatchString(base) {
+			files[strings.TrimSuffix(base, ".sql")] = entry
+		}
+	}
+	return files
+}
+
+// tree analogue of validateMigrationFilenames
+func validateTreeFilenames(tree map[string]treeEntry, dir string) []string {
+	var errs []string
+	for name, entry := range tree {
+		if entry.kind != "blob" || path.Dir(name) != dir {
+			continue
+		}
+		base := path.Base(name)
+		if base == OrderFile {
+			continue
+		}
+		if !strings.HasSuffix(base, ".up.sql") && !strings.HasSuffix(base, ".down.sql") && !strings.HasSuffix(base, ".repeatable.sql") && !callbackPattern.MatchString(base) {
+			errs = append(errs, fmt.Sprintf("ERROR: %s wrong file name suffix expect .up.sql, .down.sql, .repeatable.sql or callback name", name))
+		}
+	}
+	return errs
+}
+
+// tree analogue of findIncludes, returns missing and wrong includes as errors
+func findTreeIncludes(tree map[string]treeEntry, filePath string, visited map[string]struct{}) []string {
+	if visited == nil {
+		visited = make(map[string]struct{})
+	}
+	if _, ok := visited[filePath]; ok {
+		return nil
+	}
+	visited[filePath] = struct{}{}
+	content, err := readBlob(tree[filePath].object)
+	if err != nil {
+		return []string{fmt.Sprintf("ERROR: failed to read %s: %v", filePath, err)}
+	}
+	var errs []string
+	for _, line := range strings.Split(content, "\n") {
+		inc, ok := parseIncludeLine(line)
+		if !ok || inc == "" {
+			continue
+		}
+		if !strings.HasSuffix(inc, ".sql") {
+			errs = append(errs, fmt.Sprintf("ERROR: wrong include @%s in %s", inc, filePath))
+			continue
+		}
+		incPath := path.Join(path.Dir(filePath), inc)
+		if _, ok := tree[incPath]; !ok {
+			errs = append(errs, fmt.Sprintf("ERROR: missing include @%s in %s", inc, filePath))
+			continue
+		}
+		errs = append(errs, findTreeIncludes(tree, incPath, visited)...)
+	}
+	return errs
+}
+
+// checks catalog at commit using only git objects, so it could be run from pre-receive hook of bare repository
+func checkRef(ref string, opts checkOptions) {
+	filter := *opts.filter
+	var errors []string
+	tree, err := listTree(ref)
+	if err != nil {
+		fmt.Printf("ERROR: failed to read tree of %s: %v\n", ref, err)
+		os.Exit(1)
+	}
+	catalog := path.Clean(filepath.ToSlash(MigrationDir))
+	config, err := loadConfigAt(ref)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
+	filter = filter.merge(config)
+
+	errors = append(errors, validateTreeFilenames(tree, catalog)...)
+	mainUp, mainDown := findTreeMigrationFiles(tree, catalog)
+	for key, entry := range mainUp {
+		if _, ok := mainDown[key]; !ok {
+			errors = append(errors, fmt.Sprintf("ERROR: %s (no pair .down.sql)", entry.path))
+		}
+		errors = append(errors, findTreeIncludes(tree, entry.path, nil)...)
+	}
+	for key, entry := range mainDown {
+		if _, ok := mainUp[key]; !ok {
+			errors = append(errors, fmt.Sprintf("ERROR: %s (no pair .up.sql)", entry.path))
+		}
+		errors = append(errors, findTreeIncludes(tree, entry.path, nil)...)
+	}
+
+	gitlinks := []treeEntry{}
+	for _, entry := range tree {
+		if entry.kind == "commit" {
+			gitlinks = append(gitlinks, entry)
+		}
+	}
+
+	// sources of config at ref, submodules by default
+	sourceConfigs := config.Sources
+	if len(sourceConfigs) == 0 {
+		sourceConfigs = []SourceConfig{{Type: "submodules"}}
+	}
+	useSubmodules := false
+	// migrations subdirectory of submodules as in getSources
+	subMigrations := "migrations"
+	for _, sc := range sourceConfigs {
+		switch sc.Type {
+		case "submodules":
+			useSubmodules = true
+			if sc.Migrations != "" {
+				subMigrations = path.Clean(filepath.ToSlash(sc.Migrations))
+			}
+		case "dir", "tar":
+		default:
+			fmt.Printf("ERROR: unknown source type '%s' in %s at %s\n", sc.Type, ConfigPath, ref)
+			os.Exit(1)
+		}
+	}
+	if !useSubmodules {
+		gitlinks = nil
+	}
+
+	// catalog sources must belong to configured sources, files of submodules to submodules recorded at ref
+	unverified := make(map[string]struct{})
+	for _, files := range []map[string]treeEntry{mainUp, mainDown} {
+		for _, entry := range files {
+			content, err := readBlob(entry.object)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("ERROR: failed to read %s: %v", entry.path, err))
+				continue
+			}
+			meta := parseMigrationMetaContent(content)
+			// imported files have no source in repository
+			if meta.source == "" || meta.origin != "" {
+				continue
+			}
+			src := path.Clean(filepath.ToSlash(meta.source))
+			found := false
+			for _, link := range gitlinks {
+				if strings.HasPrefix(src, link.path+"/") {
+					found = true
+					if meta.commit == "" || !filter.match(link.path) {
+						break
+					}
+					// submodule objects are usually absent in bare repository
+					if !hasCommit(meta.commit) || !hasCommit(link.object) {
+						unverified[link.path] = struct{}{}
+						break
+					}
+					if problem := commitRelation(nil, meta.commit, link.object); problem != "" {
+						errors = append(errors, fmt.Sprintf("ERROR: %s stale submodule pointer %s: %s", entry.path, link.path, problem))
+					}
+					break
+				}
+			}
+			for _, sc := range sourceConfigs {
+				if found {
+					break
+				}
+				dir := path.Clean(filepath.ToSlash(sc.Path))
+				switch sc.Type {
+				case "dir":
+					found = strings.HasPrefix(src, dir+"/")
+				case "tar":
+					archive, _, _ := strings.Cut(filepath.ToSlash(meta.source), ":")
+					found = path.Clean(archive) == dir
+				}
+			}
+			if !found {
+				errors = append(errors, fmt.Sprintf("ERROR: %s source %s is not in any source at %s", entry.path, src, ref))
+			}
+		}
+	}
+
+	// submodule migrations, only if submodule commits are present in object database
+	var skipped []string
+	for link := range unverified {
+		skipped = append(skipped, fmt.Sprintf("%s pointer check (commits not available)", link))
+	}
+	sort.Strings(skipped)
+	for _, link := range gitlinks {
+		if !filter.match(link.path) {
+			skipped = append(skipped, link.path)
+			continue
+		}
+		if !hasCommit(link.object) {
+			skipped = append(skipped, fmt.Sprintf("%s (%s not available)", link.path, link.object))
+			continue
+		}
+		subTree, err := listTree(link.object, subMigrations)
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("ERROR: failed to read tree of %s: %v", link.path, err))
+			continue
+		}
+		errors = append(errors, validateTreeFilenames(subTree, subMigrations)...)
+		subUp, subDown := findTreeMigrationFiles(subTree, subMigrations)
+		for _, pair := range []struct {
+			sub, main map[string]treeEntry
+			suffix    string
+		}{{subUp, mainUp, ".up.sql"}, {subDown, mainDown, ".down.sql"}} {
+			for key, entry := range pair.sub {
+				mainEntry, ok := pair.main[key]
+				if !ok {
+					errors = append(errors, fmt.Sprintf("ERROR: unregistered migration %s/%s", link.path, entry.path))
+					continue
+				}
+				content, err := readBlob(mainEntry.object)
+				if err != nil {
+					continue
+				}
+				mainMeta := parseMigrationMetaContent(content)
+				subContent, err := readBlob(entry.object)
+				if err != nil {
+					continue
+				}
+				subChecksum := contentChecksum(mainMeta.algorithm, []byte(subContent))
+				if mainMeta.checksum != "" && mainMeta.checksum != subChecksum {
+					errors = append(errors, fmt.Sprintf("ERROR: migration meta mismatch for %s: main %s=%s, submodule %s=%s", key+pair.suffix, mainMeta.algorithm, mainMeta.checksum, mainMeta.algorithm, subChecksum))
+				}
+			}
+		}
+	}
+
+	if opts.locked {
+		errors = append(errors, checkLock(ref, opts.verifyKey)...)
+	}
+
+	printSkipped(skipped)
+	if len(errors) > 0 {
+		sort.Strings(errors)
+		for _, e := range errors {
+			fmt.Println(e)
+		}
+		fmt.Printf("ERROR: %s rejected, %d problem(s) found\n", ref, len(errors))
+		os.Exit(1)
+	}
+	fmt.Printf("[ok] Migrations at %s are correct.\n", ref)
+}
+
+// hasCommit reports if commit is in object database
+func hasCommit(commit string) bool {
+	_, err := runGit("cat-file", "-e", commit+"^{commit}")
+	return err == nil
+}
+
+// commitRelation describes why recorded commit of catalog file does not match gitlink,
+// empty if recorded commit is gitlink or its ancestor. gitArgs are prepended to git commands.
+func commitRelation(gitArgs []string, recorded, gitlink string) string {
+	if recorded == gitlink {
+		return ""
+	}
+	git := func(args ...string) error {
+		_, err := runGit(append(append([]string{}, gitArgs...), args...)...)
+		return err
+	}
+	if err := git("cat-file", "-e", recorded+"^{commit}"); err != nil {
+		return fmt.Sprintf("collected from unknown commit %s", recorded)
+	}
+	if err := git("merge-base", "--is-ancestor", recorded, gitlink); err == nil {
+		return ""
+	}
+	if err := git("merge-base", "--is-ancestor", gitlink, recorded); err == nil {
+		return fmt.Sprintf("collected from commit %s ahead of gitlink %s", recorded, gitlink)
+	}
+	return fmt.Sprintf("collected from commit %s not reachable from gitlink %s", recorded, gitlink)
+}
+
+// checks that catalog files collected from submodule are not newer than submodule gitlink
+func checkSubmoduleCommits(sub *submoduleSource, mainUp, mainDown map[string]string) []string {
+	gitlink, err := sub.gitlink()
+	if err != nil {
+		return []string{fmt.Sprintf("ERROR: failed to get gitlink of %s: %v", sub.path, err)}
+	}
+	prefix := filepath.ToSlash(filepath.Clean(sub.path)) + "/"
+	relations := make(map[string]string)
+	var errs []string
+	for _, files := range []map[string]string{mainUp, mainDown} {
+		for _, mainPath := range files {
+			meta := parseMigrationMeta(mainPath)
+			if meta.commit == "" || !strings.HasPrefix(filepath.ToSlash(filepath.Clean(meta.source)), prefix) {
+				continue
+			}
+			problem, ok := relations[meta.commit]
+			if !ok {
+				problem = commitRelation([]string{"-C", sub.path}, meta.commit, gitlink)
+				relations[meta.commit] = problem
+			}
+			if problem != "" {
+				errs = append(errs, fmt.Sprintf("ERROR: %s stale submodule pointer %s: %s", mainPath, sub.path, problem))
+			}
+		}
+	}
+	return errs
+}
+
+// Lock is a manifest of catalog written by collect to LockPath
+type Lock struct {
+	Version    int         `json:"version"`
+	Migrations []LockEntry `json:"migrations"`
+	// Signature is base64 ed25519 signature of the lock marshaled without signature
+	Signature string `json:"signature,omitempty"`
+}
+
+// LockEntry is a catalog up and down pair, repeatable or callback script
+type LockEntry struct {
+	Key        string     `json:"key"`
+	Up         *LockFile  `json:"up,omitempty"`
+	Down       *LockFile  `json:"down,omitempty"`
+	Repeatable *LockFile  `json:"repeatable,omitempty"`
+	Callback   *LockFile  `json:"callback,omitempty"`
+	Includes   []LockFile `json:"includes,omitempty"`
+}
+
+// LockFile is a catalog file, its checksum and source recorded in meta header
+type LockFile struct {
+	File   string `json:"file"`
+	SHA256 string `json:"sha256"`
+	Source string `json:"source,omitempty"`
+}
+
+func lockFile(read func(string) ([]byte, error), file string) (LockFile, error) {
+	content, err := read(file)
+	if err != nil {
+		return LockFile{}, err
+	}
+	return LockFile{
+		File:   filepath.ToSlash(file),
+		SHA256: contentChecksum("sha256", content),
+		Source: parseMigrationMetaContent(string(content)).source,
+	}, nil
+}
+
+// builds lock of current catalog content
+func buildLock() (Lock, error) {
+	catalog, err := snapshotAt("")
+	if err != nil {
+		return Lock{Version: 1}, err
+	}
+	return buildLockOf(catalog)
+}
+
+// builds lock of catalog snapshot
+func buildLockOf(catalog catalogSnapshot) (Lock, error) {
+	lock := Lock{Version: 1}
+	mainUp, mainDown, mainRepeatable, mainCallbacks := catalog.up, catalog.down, catalog.repeatable, catalog.callbacks
+	keys := map[string]struct{}{}
+	for _, m := range []map[string]string{mainUp, mainDown, mainRepeatable, mainCallbacks} {
+		for key := range m {
+			keys[key] = struct{}{}
+		}
+	}
+	for key := range keys {
+		entry := LockEntry{Key: key}
+		included := map[string]struct{}{}
+		for _, file := range []string{mainUp[key], mainDown[key], mainRepeatable[key], mainCallbacks[key]} {
+			if file == "" {
+				continue
+			}
+			lf, err := lockFile(catalog.read, file)
+			if err != nil {
+				return lock, err
+			}
+			switch file {
+			case mainUp[key]:
+				entry.Up = &lf
+			case mainDown[key]:
+				entry.Down = &lf
+			case mainRepeatable[key]:
+				entry.Repeatable = &lf
+			default:
+				entry.Callback = &lf
+			}
+			includes, _ := readIncludes(catalog.read, file, nil)
+			for _, inc := range includes {
+				incPath := filepath.Join(filepath.Dir(file), inc)
+				if _, ok := included[incPath]; ok {
+					continue
+				}
+				included[incPath] = struct{}{}
+				lf, err := lockFile(catalog.read, incPath)
+				if err != nil {
+					return lock, err
+				}
+				lf.Source = ""
+				entry.Includes = append(entry.Includes, lf)
+			}
+		}
+		sort.Slice(entry.Includes, func(i, j int) bool { return entry.Includes[i].File < entry.Includes[j].File })
+		lock.Migrations = append(lock.Migrations, entry)
+	}
+	sort.Slice(lock.Migrations, func(i, j int) bool { return lock.Migrations[i].Key < lock.Migrations[j].Key })
+	return lock, nil
+}
+
+// returns bytes covered by lock signature
+func (l Lock) signedContent() ([]byte, error) {
+	l.Signature = ""
+	return json.Marshal(l)
+}
+
+// refreshLock rewrites LockPath after change of catalog in dir, if the lock file exists and is of dir
+func refreshLock(dir string) error {
+	if filepath.Clean(dir) != filepath.Clean(MigrationDir) {
+		return nil
+	}
+	if _, err := os.Stat(LockPath); err != nil {
+		return nil
+	}
+	return writeLock("")
+}
+
+// writes lock of current catalog, signs it if key is given by flag or config
+func writeLock(signKey string) error {
+	lock, err := buildLock()
+	if err != nil {
+		return err
+	}
+	if signKey == "" {
+		config, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		signKey = config.SignKey
+	}
+	if signKey != "" {
+		key, err := readPrivateKey(signKey)
+		if err != nil {
+			return err
+		}
+		content, err := lock.signedContent()
+		if err != nil {
+			return err
+		}
+		lock.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, content))
+	}
+	output, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(LockPath, append(output, '\n'), 0644)
+}
+
+func readPrivateKey(file string) (ed25519.PrivateKey, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", file)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", file, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not ed25519 private key", file)
+	}
+	return edKey, nil
+}
+
+func readPublicKey(file string) (ed25519.PublicKey, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", file)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", file, err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not ed25519 public key", file)
+	}
+	return edKey, nil
+}
+
+// compares catalog with LockPath and verifies lock signature, both are taken at ref if it is given
+func checkLock(ref, verifyKey string) []string {
+	var content []byte
+	var err error
+	if ref == "" {
+		content, err = os.ReadFile(LockPath)
+	} else {
+		content, err = runGit("show", ref+":"+path.Clean(filepath.ToSlash(LockPath)))
+	}
+	if err != nil {
+		return []string{fmt.Sprintf("ERROR: failed to read lock file: %v", err)}
+	}
+	var locked Lock
+	if err := json.Unmarshal(content, &locked); err != nil {
+		return []string{fmt.Sprintf("ERROR: failed to parse lock file %s: %v", LockPath, err)}
+	}
+	var errs []string
+
+	if verifyKey == "" {
+		config, err := loadConfig()
+		if ref != "" {
+			config, err = loadConfigAt(ref)
+		}
+		if err != nil {
+			return []string{fmt.Sprintf("ERROR: %v", err)}
+		}
+		verifyKey = config.VerifyKey
+	}
+	switch {
+	case verifyKey != "" && locked.Signature == "":
+		errs = append(errs, fmt.Sprintf("ERROR: lock file %s is not signed", LockPath))
+	case verifyKey == "" && locked.Signature != "":
+		errs = append(errs, fmt.Sprintf("ERROR: lock file %s is signed, but no verify key is given", LockPath))
+	case verifyKey != "":
+		key, err := readPublicKey(verifyKey)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("ERROR: %v", err))
+			break
+		}
+		signature, err := base64.StdEncoding.DecodeString(locked.Signature)
+		signed, _ := locked.signedContent()
+		if err != nil || !ed25519.Verify(key, signed, signature) {
+			errs = append(errs, fmt.Sprintf("ERROR: lock file %s signature does not verify", LockPath))
+		}
+	}
+
+	catalog, err := snapshotAt(ref)
+	if err != nil {
+		return append(errs, fmt.Sprintf("ERROR: %v", err))
+	}
+	current, err := buildLockOf(catalog)
+	if err != nil {
+		return append(errs, fmt.Sprintf("ERROR: %v", err))
+	}
+	lockedEntries := make(map[string]LockEntry)
+	for _, entry := range locked.Migrations {
+		lockedEntries[entry.Key] = entry
+	}
+	for _, entry := range current.Migrations {
+		lockedEntry, ok := lockedEntries[entry.Key]
+		delete(lockedEntries, entry.Key)
+		if !ok {
+			errs = append(errs, fmt.Sprintf("ERROR: %s is not in lock file", entry.Key))
+			continue
+		}
+		a, _ := json.Marshal(entry)
+		b, _ := json.Marshal(lockedEntry)
+		if string(a) != string(b) {
+			errs = append(errs, fmt.Sprintf("ERROR: %s differs from lock file", entry.Key))
+		}
+	}
+	for key := range lockedEntries {
+		errs = append(errs, fmt.Sprintf("ERROR: %s from lock file is missing in catalog", key))
+	}
+	return errs
+}
+
+// diff prints differences between catalog migrations with their includes and sources recorded in meta,
+// all catalog migrations are compared if key is empty
+func diff(key string, stat bool) {
+	mainUp, mainDown, err := findMigrationFiles(MigrationDir)
+	if err != nil {
+		fmt.Println("Error finding migration files:", err)
+		os.Exit(1)
+	}
+	var files []string
+	for _, m := range []map[string]string{mainUp, mainDown} {
+		for k, file := range m {
+			if key == "" || k == key {
+				files = append(files, file)
+			}
+		}
+	}
+	if len(files) == 0 {
+		fmt.Printf("ERROR: migration %s not found\n", key)
+		os.Exit(1)
+	}
+	sort.Strings(files)
+
+	color := useColor()
+	changed, added, removed := 0, 0, 0
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			continue
+		}
+		header, body := splitMigrationMeta(string(content))
+		meta := parseMigrationMetaContent(header)
+		if meta.source == "" {
+			continue
+		}
+		pairs := [][2]string{{file, meta.source}}
+		includes, _ := findIncludes(file, nil)
+		for _, inc := range includes {
+			pairs = append(pairs, [2]string{
+				filepath.Join(filepath.Dir(file), inc),
+				path.Join(path.Dir(filepath.ToSlash(meta.source)), filepath.ToSlash(inc)),
+			})
+		}
+		for i, pair := range pairs {
+			old := body
+			if i > 0 {
+				incContent, err := os.ReadFile(pair[0])
+				if err != nil {
+					fmt.Println("ERROR:", err)
+					continue
+				}
+				old = string(incContent)
+			}
+			source, err := readOrigin(pair[1])
+			if err != nil {
+				fmt.Printf("ERROR: failed to read source %s: %v\n", pair[1], err)
+				continue
+			}
+			text, a, r := unifiedDiff(pair[0], pair[1], old, string(source), color)
+			if a == 0 && r == 0 {
+				continue
+			}
+			changed++
+			added += a
+			removed += r
+			if stat {
+				fmt.Printf(" %s | %d %s\n", pair[0], a+r, colorize(color, "\033[32m", strings.Repeat("+", a))+colorize(color, "\033[31m", strings.Repeat("-", r)))
+			} else {
+				fmt.Print(text)
+			}
+		}
+	}
+	if stat {
+		fmt.Printf(" %d file(s) changed, %d insertion(s)(+), %d deletion(s)(-)\n", changed, added, removed)
+	}
+}
+
+// colors are used only on terminal, NO_COLOR and TERM=dumb disable them like in describe.sh
+func useColor() bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func colorize(color bool, code, text string) string {
+	if !color || text == "" {
+		return text
+	}
+	return code + text + "\033[0m"
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// diffLines returns edit script of a to b by longest common subsequence, ops are ' ', '-' and '+'
+func diffLines(a, b []string) ([]byte, []string) {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var ops []byte
+	var lines []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops, lines = append(ops, ' '), append(lines, a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops, lines = append(ops, '-'), append(lines, a[i])
+			i++
+		default:
+			ops, lines = append(ops, '+'), append(lines, b[j])
+			j++
+		}
+	}
+	return ops, lines
+}
+
+// unifiedDiff formats diff of a and b with 3 context lines, returns text and counts of added and removed lines
+func unifiedDiff(aName, bName, a, b string, color bool) (string, int, int) {
+	const context = 3
+	ops, lines := diffLines(splitLines(a), splitLines(b))
+	added, removed := 0, 0
+	for _, op := range ops {
+		switch op {
+		case '+':
+			added++
+		case '-':
+			removed++
+		}
+	}
+	if added == 0 && removed == 0 {
+		return "", 0, 0
+	}
+	var out strings.Builder
+	out.WriteString(colorize(color, "\033[1m", "--- "+aName) + "\n")
+	out.WriteString(colorize(color, "\033[1m", "+++ "+bName) + "\n")
+
+	// line numbers in a and b before each op
+	aLine := make([]int, len(ops)+1)
+	bLine := make([]int, len(ops)+1)
+	for k, op := range ops {
+		aLine[k+1], bLine[k+1] = aLine[k], bLine[k]
+		if op != '+' {
+			aLine[k+1]++
+		}
+		if op != '-' {
+			bLine[k+1]++
+		}
+	}
+	for k := 0; k < len(ops); {
+		if ops[k] == ' ' {
+			k++
+			continue
+		}
+		start := max(k-context, 0)
+		end := k
+		for end < len(ops) {
+			if ops[end] != ' ' {
+				end++
+				continue
+			}
+			next := end
+			for next < len(ops) && ops[next] == ' ' {
+				next++
+			}
+			if next == len(ops) || next-end > 2*context {
+				end = min(end+context, len(ops))
+				break
+			}
+			end = next
+		}
+		fmt.Fprintf(&out, "%s\n", colorize(color, "\033[36m", fmt.Sprintf("@@ -%d,%d +%d,%d @@",
+			aLine[start]+1, aLine[end]-aLine[start], bLine[start]+1, bLine[end]-bLine[start])))
+		for _, op := range ops[start:end] {
+			line := string(op) + lines[start]
+			switch op {
+			case '+':
+				line = colorize(color, "\033[32m", line)
+			case '-':
+				line = colorize(color, "\033[31m", line)
+			}
+			out.WriteString(line + "\n")
+			start++
+		}
+		k = end
+	}
+	return out.String(), added, removed
+}
+
+var migrationKeyPattern = regexp.MustCompile(`^(.+)-(\d+)(_[a-z0-9_]+)?$`)
+
+// splits migration key project-version-release-N[_description] into base, number and suffix
+func parseMigrationKey(key string) (string, int, string, bool) {
+	matches := migrationKeyPattern.FindStringSubmatch(key)
+	if matches == nil {
+		return "", 0, "", false
+	}
+	number, err := strconv.Atoi(matches[2])
+	if err != nil {
+		return "", 0, "", false
+	}
+	return matches[1], number, matches[3], true
+}
+
+// fileAdd is a commit which added file
+type fileAdd struct {
+	commit string
+	time   int64
+}
+
+// catalogAdds returns commits which added files of dir, newest first
+func catalogAdds(dir string) map[string][]fileAdd {
+	adds := make(map[string][]fileAdd)
+	output, err := runGit("log", "--full-history", "--diff-filter=A", "--relative", "--name-only", "--format=commit %H %ct", "--", dir)
+	if err != nil {
+		return adds
+	}
+	var current fileAdd
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, "commit ") {
+			fields := strings.Fields(line)
+			if len(fields) == 3 {
+				current.commit = fields[1]
+				current.time, _ = strconv.ParseInt(fields[2], 10, 64)
+			}
+			continue
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			name := filepath.Clean(line)
+			adds[name] = append(adds[name], current)
+		}
+	}
+	return adds
+}
+
+// first add time of migration pair, not committed pairs are the latest
+func pairAddTime(adds map[string][]fileAdd, files ...string) int64 {
+	var first int64 = math.MaxInt64
+	for _, file := range files {
+		fileAdds := adds[filepath.Clean(file)]
+		if len(fileAdds) > 0 && fileAdds[len(fileAdds)-1].time < first {
+			first = fileAdds[len(fileAdds)-1].time
+		}
+	}
+	return first
+}
+
+// numberConflict is a set of different migrations with the same number, ordered by add time
+type numberConflict struct {
+	keys []string
+}
+
+func (c numberConflict) String() string {
+	return fmt.Sprintf("%s (later added %s)", strings.Join(c.keys, ", "), c.keys[len(c.keys)-1])
+}
+
+// groups catalog keys by number, returns groups with more then one key
+func numberConflicts(mainUp, mainDown map[string]string) []numberConflict {
+	groups := make(map[string][]string)
+	seen := make(map[string]struct{})
+	for _, m := range []map[string]string{mainUp, mainDown} {
+		for key := range m {
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			base, number, _, ok := parseMigrationKey(key)
+			if !ok {
+				continue
+			}
+			id := fmt.Sprintf("%s-%d", base, number)
+			groups[id] = append(groups[id], key)
+		}
+	}
+	var conflicts []numberConflict
+	var adds map[string][]fileAdd
+	for _, keys := range groups {
+		if len(keys) < 2 {
+			continue
+		}
+		if adds == nil {
+			adds = catalogAdds(MigrationDir)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			ti := pairAddTime(adds, mainUp[keys[i]], mainDown[keys[i]])
+			tj := pairAddTime(adds, mainUp[keys[j]], mainDown[keys[j]])
+			if ti != tj {
+				return ti < tj
+			}
+			return keys[i] < keys[j]
+		})
+		conflicts = append(conflicts, numberConflict{keys: keys})
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].keys[0] < conflicts[j].keys[0] })
+	return conflicts
+}
+
+// findNumberConflicts reports same number migrations and files added independently on merged branches,
+// which means one of them was silently overwritten
+func findNumberConflicts(mainUp, mainDown map[string]string) []string {
+	var found []string
+	for _, c := range numberConflicts(mainUp, mainDown) {
+		found = append(found, c.String())
+	}
+	adds := catalogAdds(MigrationDir)
+	var commits []string
+	for _, fileAdds := range adds {
+		if len(fileAdds) < 2 {
+			continue
+		}
+		for _, add := range fileAdds {
+			commits = append(commits, add.commit)
+		}
+	}
+	ancestors := addAncestors(commits)
+	for file, fileAdds := range adds {
+		for i := 0; i < len(fileAdds); i++ {
+			for j := i + 1; j < len(fileAdds); j++ {
+				a, b := fileAdds[i].commit, fileAdds[j].commit
+				if ancestors[a] == nil || ancestors[b] == nil {
+					continue
+				}
+				if !ancestors[a][b] && !ancestors[b][a] {
+					found = append(found, fmt.Sprintf("%s added on merged branches by %s and %s, one version is overwritten", file, fileAdds[j].commit[:12], fileAdds[i].commit[:12]))
+				}
+			}
+		}
+	}
+	sort.Strings(found)
+	return found
+}
+
+// addAncestors returns for each of commits which other ones are its ancestors,
+// history of all of them is read by one git rev-list and walked once per commit
+func addAncestors(commits []string) map[string]map[string]bool {
+	ancestors := make(map[string]map[string]bool)
+	if len(commits) == 0 {
+		return ancestors
+	}
+	output, err := runGit(append([]string{"rev-list", "--parents"}, commits...)...)
+	if err != nil {
+		return ancestors
+	}
+	parents := make(map[string][]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			parents[fields[0]] = fields[1:]
+		}
+	}
+	wanted := make(map[string]bool)
+	for _, commit := range commits {
+		wanted[commit] = true
+	}
+	for commit := range wanted {
+		found := make(map[string]bool)
+		visited := map[string]bool{commit: true}
+		stack := append([]string(nil), parents[commit]...)
+		for len(stack) > 0 {
+			current := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if visited[current] {
+				continue
+			}
+			visited[current] = true
+			if wanted[current] {
+				found[current] = true
+			}
+			stack = append(stack, parents[current]...)
+		}
+		ancestors[commit] = found
+	}
+	return ancestors
+}
+
+// renumber moves migration pair to next free number of its series, without key
+// it moves later added migrations of every number conflict
+func renumber(key string) {
+	mainUp, mainDown, err := findMigrationFiles(MigrationDir)
+	if err != nil {
+		fmt.Println("Error finding migration files:", err)
+		os.Exit(1)
+	}
+	var keys []string
+	if key != "" {
+		if _, ok := mainUp[key]; !ok {
+			if _, ok := mainDown[key]; !ok {
+				fmt.Printf("ERROR: migration %s not found\n", key)
+				os.Exit(1)
+			}
+		}
+		keys = append(keys, key)
+	} else {
+		for _, c := range numberConflicts(mainUp, mainDown) {
+			keys = append(keys, c.keys[1:]...)
+		}
+	}
+	if len(keys) == 0 {
+		fmt.Println("[ok] nothing to renumber")
+		return
+	}
+	for _, key := range keys {
+		newKey, err := renumberMigration(key, mainUp, mainDown)
+		if err != nil {
+			fmt.Printf("ERROR: failed to renumber %s: %v\n", key, err)
+			os.Exit(1)
+		}
+		fmt.Printf("[ok] renumbered %s to %s\n", key, newKey)
+	}
+	if _, err := os.Stat(LockPath); err == nil {
+		if err := writeLock(""); err != nil {
+			fmt.Println("Error writing lock file:", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// renames pair to next free number and replaces its file names in catalog scripts,
+// collected pairs are refused as collect would bring them back under old number
+func renumberMigration(key string, mainUp, mainDown map[string]string) (string, error) {
+	base, _, suffix, ok := parseMigrationKey(key)
+	if !ok {
+		return "", fmt.Errorf("wrong migration name")
+	}
+	for _, m := range []map[string]string{mainUp, mainDown} {
+		file, ok := m[key]
+		if !ok {
+			continue
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		if meta := parseMigrationMetaContent(string(content)); meta.source != "" && meta.origin == "" {
+			return "", fmt.Errorf("it is collected from %s, renumber it in its source and collect again", meta.source)
+		}
+	}
+	last, err := FindLastMigrationNumber(MigrationDir, base)
+	if err != nil {
+		return "", err
+	}
+	newKey := fmt.Sprintf("%s-%d%s", base, last+1, suffix)
+	replacer := strings.NewReplacer(key+".up.sql", newKey+".up.sql", key+".down.sql", newKey+".down.sql")
+
+	for _, m := range []map[string]string{mainUp, mainDown} {
+		for k, file := range m {
+			content, err := os.ReadFile(file)
+			if err != nil {
+				return "", err
+			}
+			// meta header keeps origin name
+			header, body := splitMigrationMeta(string(content))
+			if header != "" {
+				header += "\n"
+			}
+			updated := header + replacer.Replace(body)
+			target := file
+			if k == key {
+				target = filepath.Join(filepath.Dir(file), strings.Replace(filepath.Base(file), key, newKey, 1))
+			}
+			if updated == string(content) && target == file {
+				continue
+			}
+			if err := os.WriteFile(target, []byte(updated), 0644); err != nil {
+				return "", err
+			}
+			if target != file {
+				if err := os.Remove(file); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+	for _, m := range []map[string]string{mainUp, mainDown} {
+		if file, ok := m[key]; ok {
+			m[newKey] = filepath.Join(filepath.Dir(file), strings.Replace(filepath.Base(file), key, newKey, 1))
+			delete(m, key)
+		}
+	}
+	if err := renameOrder(MigrationDir, key, newKey); err != nil {
+		return "", err
+	}
+	return newKey, nil
+}
+
+var (
+	seriesPattern     = regexp.MustCompile(`^(.+)-([^-]+)-(\d+)$`)
+	tagVersionPattern = regexp.MustCompile(`^([0-9]+\.[0-9]+\.[0-9]+)-`)
+)
+
+// returns version of migration series base project-version-release
+func seriesVersion(base string) string {
+	matches := seriesPattern.FindStringSubmatch(base)
+	if matches == nil {
+		return ""
+	}
+	return matches[2]
+}
+
+// converts release tag to version the same way as describe.sh version_tag
+func tagVersion(tag string) string {
+	return tagVersionPattern.ReplaceAllString(strings.TrimPrefix(tag, "v"), "$1~")
+}
+
+// tagged catalog keys by release tag
+func taggedCatalogs() map[string]map[string]struct{} {
+	tagged := make(map[string]map[string]struct{})
+	output, err := runGit("tag", "--list", "v[0-9]*")
+	if err != nil {
+		return tagged
+	}
+	catalog := path.Clean(filepath.ToSlash(MigrationDir))
+	for _, tag := range strings.Fields(string(output)) {
+		tree, err := listTree(tag, catalog)
+		if err != nil {
+			continue
+		}
+		up, down := findTreeMigrationFiles(tree, catalog)
+		keys := make(map[string]struct{})
+		for _, m := range []map[string]treeEntry{up, down} {
+			for key := range m {
+				keys[key] = struct{}{}
+			}
+		}
+		tagged[tag] = keys
+	}
+	return tagged
+}
+
+// catalog keys deleted in git history
+func deletedCatalogKeys() []string {
+	output, err := runGit("log", "--full-history", "--diff-filter=D", "--relative", "--name-only", "--format=", "--", MigrationDir)
+	if err != nil {
+		return nil
+	}
+	var keys []string
+	for _, line := range strings.Split(string(output), "\n") {
+		name := filepath.Base(strings.TrimSpace(line))
+		if key, ok := strings.CutSuffix(name, ".up.sql"); ok {
+			keys = append(keys, key)
+		} else if key, ok := strings.CutSuffix(name, ".down.sql"); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// checkSequence checks numbering of project-version-release series, rules are
+//
+//	gap                  numbers are not contiguous from 1
+//	duplicate            number was used by deleted migration
+//	lower-than-tagged    not tagged migration has number lower than tagged one of the same series
+//	added-after-release  migration is added to version which already has release tag
+//
+// returns problems of rules with error and warning policy
+func checkSequence(mainUp, mainDown map[string]string, config Config) ([]string, []string) {
+	var errs, warns []string
+	report := func(rule, problem string) {
+		switch config.policy(rule) {
+		case "error":
+			errs = append(errs, problem)
+		case "warning":
+			warns = append(warns, problem)
+		}
+	}
+
+	goKeys := make(map[string]string)
+	for key := range goMigrations {
+		goKeys[key] = ""
+	}
+	keys := make(map[string]struct{})
+	series := make(map[string]map[int][]string)
+	for _, m := range []map[string]string{mainUp, mainDown, goKeys} {
+		for key := range m {
+			if _, ok := keys[key]; ok {
+				continue
+			}
+			keys[key] = struct{}{}
+			base, number, _, ok := parseMigrationKey(key)
+			if !ok {
+				continue
+			}
+			if series[base] == nil {
+				series[base] = make(map[int][]string)
+			}
+			series[base][number] = append(series[base][number], key)
+		}
+	}
+
+	if config.policy("gap") != "off" && (config.Naming == "" || config.Naming == "counter") {
+		// missing numbers are reported as ranges, numbers could be far apart
+		for base, numbers := range series {
+			sorted := []int{0}
+			for number := range numbers {
+				sorted = append(sorted, number)
+			}
+			sort.Ints(sorted)
+			for i := 1; i < len(sorted); i++ {
+				switch from, to := sorted[i-1]+1, sorted[i]-1; {
+				case from == to:
+					report("gap", fmt.Sprintf("%s-%d is missing (gap)", base, from))
+				case from < to:
+					report("gap", fmt.Sprintf("%s-%d..%d are missing (gap)", base, from, to))
+				}
+			}
+		}
+	}
+
+	if config.policy("duplicate") != "off" {
+		reported := make(map[string]struct{})
+		for _, deleted := range deletedCatalogKeys() {
+			if _, ok := keys[deleted]; ok {
+				if _, ok := reported[deleted]; !ok {
+					report("duplicate", fmt.Sprintf("%s was deleted and added again (duplicate)", deleted))
+					reported[deleted] = struct{}{}
+				}
+				continue
+			}
+			base, number, _, ok := parseMigrationKey(deleted)
+			if !ok {
+				continue
+			}
+			for _, key := range series[base][number] {
+				if _, ok := reported[key]; !ok {
+					report("duplicate", fmt.Sprintf("%s reuses number of deleted %s (duplicate)", key, deleted))
+					reported[key] = struct{}{}
+				}
+			}
+		}
+	}
+
+	if config.policy("lower-than-tagged") != "off" || config.policy("added-after-release") != "off" {
+		checkTagged(keys, report)
+	}
+	sort.Strings(errs)
+	sort.Strings(warns)
+	return errs, warns
+}
+
+// checks not tagged catalog keys against release tags
+func checkTagged(keys map[string]struct{}, report func(rule, problem string)) {
+	tagged := taggedCatalogs()
+	inTag := make(map[string]struct{})
+	taggedMax := make(map[string]int)
+	versionTags := make(map[string]string)
+	for tag, tagKeys := range tagged {
+		versionTags[tagVersion(tag)] = tag
+		for key := range tagKeys {
+			inTag[key] = struct{}{}
+			if base, number, _, ok := parseMigrationKey(key); ok {
+				taggedMax[base] = max(taggedMax[base], number)
+			}
+		}
+	}
+	for key := range keys {
+		if _, ok := inTag[key]; ok {
+			continue
+		}
+		base, number, _, ok := parseMigrationKey(key)
+		if !ok {
+			continue
+		}
+		if number < taggedMax[base] {
+			report("lower-than-tagged", fmt.Sprintf("%s is not tagged, but tagged %s-%d exists (lower-than-tagged)", key, base, taggedMax[base]))
+		}
+		if tag, ok := versionTags[seriesVersion(base)]; ok {
+			report("added-after-release", fmt.Sprintf("%s is added after release tag %s (added-after-release)", key, tag))
+		}
+	}
+}
+
+// releasedFile is a catalog file at release tag of its version
+type releasedFile struct {
+	key    string
+	tag    string
+	object string
+}
+
+// released catalog files by path, files are taken from tag of their series version
+func releasedFiles() map[string]releasedFile {
+	released := make(map[string]releasedFile)
+	output, err := runGit("tag", "--list", "v[0-9]*")
+	if err != nil {
+		return released
+	}
+	catalog := path.Clean(filepath.ToSlash(MigrationDir))
+	for _, tag := range strings.Fields(string(output)) {
+		tree, err := listTree(tag, catalog)
+		if err != nil {
+			continue
+		}
+		up, down := findTreeMigrationFiles(tree, catalog)
+		for _, m := range []map[string]treeEntry{up, down} {
+			for key, entry := range m {
+				base, _, _, ok := parseMigrationKey(key)
+				if !ok || tagVersion(tag) != seriesVersion(base) {
+					continue
+				}
+				released[filepath.Clean(filepath.FromSlash(entry.path))] = releasedFile{key: key, tag: tag, object: entry.object}
+			}
+		}
+	}
+	return released
+}
+
+// splits #amended: lines out of content, they record accepted changes of released migration:
+//
+//	#amended: tag=<tag> checksum=sha256:<hex> reason=<escaped text>
+func splitAmended(content string) (string, []migrationMeta) {
+	var amended []migrationMeta
+	var lines []string
+	for _, line := range strings.SplitAfter(content, "\n") {
+		if strings.HasPrefix(line, "#amended:") {
+			amended = append(amended, parseMetaV2(strings.TrimPrefix(line, "#amended:")))
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, ""), amended
+}
+
+// checkReleased reports released catalog files which differ from their release tag or were deleted,
+// changes accepted with #amended: line of current content checksum are allowed
+func checkReleased(mainUp, mainDown map[string]string, config Config) ([]string, []string) {
+	var errs, warns []string
+	policy := config.policy("modified-after-release")
+	if policy == "off" {
+		return nil, nil
+	}
+	report := func(problem string) {
+		if policy == "error" {
+			errs = append(errs, problem)
+		} else {
+			warns = append(warns, problem)
+		}
+	}
+	current := make(map[string]struct{})
+	for _, m := range []map[string]string{mainUp, mainDown} {
+		for _, file := range m {
+			current[filepath.Clean(file)] = struct{}{}
+		}
+	}
+	for file, released := range releasedFiles() {
+		if _, ok := current[file]; !ok {
+			report(fmt.Sprintf("%s deleted after release %s", file, released.tag))
+			continue
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			report(fmt.Sprintf("%s: %v", file, err))
+			continue
+		}
+		original, err := readBlob(released.object)
+		if err != nil {
+			continue
+		}
+		body, amended := splitAmended(string(content))
+		if body == original {
+			continue
+		}
+		accepted := false
+		for _, a := range amended {
+			if a.checksum == contentChecksum(a.algorithm, []byte(body)) {
+				accepted = true
+			}
+		}
+		if !accepted {
+			report(fmt.Sprintf("%s modified after release %s", file, released.tag))
+		}
+	}
+	sort.Strings(errs)
+	sort.Strings(warns)
+	return errs, warns
+}
+
+// records #amended: line with reason in changed released files of keys
+func amendReleased(keys []string, reason string, mainUp, mainDown map[string]string) error {
+	if strings.TrimSpace(reason) == "" {
+		return fmt.Errorf("--allow-amend requires --reason")
+	}
+	released := releasedFiles()
+	for _, key := range keys {
+		amended := 0
+		for _, m := range []map[string]string{mainUp, mainDown} {
+			file, ok := m[key]
+			if !ok {
+				continue
+			}
+			rel, ok := released[filepath.Clean(file)]
+			if !ok {
+				continue
+			}
+			content, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			original, err := readBlob(rel.object)
+			if err != nil {
+				return err
+			}
+			body, _ := splitAmended(string(content))
+			if body == original {
+				continue
+			}
+			line := fmt.Sprintf("#amended: tag=%s checksum=sha256:%s reason=%s\n", rel.tag, contentChecksum("sha256", []byte(body)), escapeMetaValue(reason))
+			// after meta header and name comment line
+			lines := strings.SplitAfter(string(content), "\n")
+			at := 0
+			for at < len(lines) && (isMetaLine(strings.TrimSpace(lines[at])) || strings.HasPrefix(lines[at], "#amended:") ||
+				(strings.HasPrefix(lines[at], "# ") && strings.HasSuffix(strings.TrimSpace(lines[at]), ".sql"))) {
+				at++
+			}
+			updated := strings.Join(lines[:at], "") + line + strings.Join(lines[at:], "")
+			if err := os.WriteFile(file, []byte(updated), 0644); err != nil {
+				return err
+			}
+			amended++
+		}
+		if amended == 0 {
+			return fmt.Errorf("%s has no changed released files", key)
+		}
+		fmt.Printf("[ok] amended %s: %s\n", key, reason)
+	}
+	if err := refreshLock(MigrationDir); err != nil {
+		return fmt.Errorf("failed to write lock file: %v", err)
+	}
+	return nil
+}
+
+// readOrder returns migration keys listed in ORDER file of dir, nil if there is no ORDER file,
+// empty lines and lines starting with # are skipped
+func readOrder(dir string) ([]string, error) {
+	content, err := os.ReadFile(filepath.Join(dir, OrderFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	return keys, nil
+}
+
+// appendOrder adds key to ORDER, new ORDER is seeded with other keys of dir in sortKeys order
+func appendOrder(dir, key string) error {
+	order, err := readOrder(dir)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	if order == nil {
+		up, down, err := findMigrationFiles(dir)
+		if err != nil {
+			return err
+		}
+		for goKey := range goMigrations {
+			up[goKey] = ""
+		}
+		for _, k := range sortKeys(up, down) {
+			if k != key {
+				keys = append(keys, k)
+			}
+		}
+	}
+	for _, k := range order {
+		if k == key {
+			return nil
+		}
+	}
+	keys = append(keys, key)
+	f, err := os.OpenFile(filepath.Join(dir, OrderFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if _, err := fmt.Fprintln(f, k); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// renameOrder replaces key in ORDER by newKey, empty newKey removes key, comments are kept
+func renameOrder(dir, key, newKey string) error {
+	file := filepath.Join(dir, OrderFile)
+	content, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		if strings.TrimSpace(line) == key {
+			if newKey == "" {
+				continue
+			}
+			line = strings.Replace(line, key, newKey, 1)
+		}
+		lines = append(lines, line)
+	}
+	return os.WriteFile(file, []byte(strings.Join(lines, "")), 0644)
+}
+
+// checkOrder validates ORDER file against catalog, ORDER is required for order naming
+func checkOrder(dir string, mainUp, mainDown map[string]string, config Config) []string {
+	order, err := readOrder(dir)
+	if err != nil {
+		return []string{fmt.Sprintf("ERROR: failed to read %s: %v", OrderFile, err)}
+	}
+	if order == nil {
+		if config.Naming == "order" {
+			return []string{fmt.Sprintf("ERROR: %s is missing in %s", OrderFile, dir)}
+		}
+		return nil
+	}
+	var errs []string
+	listed := make(map[string]struct{})
+	for _, key := range order {
+		if _, ok := listed[key]; ok {
+			errs = append(errs, fmt.Sprintf("ERROR: %s is listed in %s more than once", key, OrderFile))
+			continue
+		}
+		listed[key] = struct{}{}
+		_, hasUp := mainUp[key]
+		_, hasDown := mainDown[key]
+		_, isGo := goMigrations[key]
+		if !hasUp && !hasDown && !isGo {
+			errs = append(errs, fmt.Sprintf("ERROR: %s from %s not found in %s", key, OrderFile, dir))
+		}
+	}
+	for key := range goMigrations {
+		if _, ok := listed[key]; !ok {
+			errs = append(errs, fmt.Sprintf("ERROR: Go migration %s is not listed in %s", key, OrderFile))
+		}
+	}
+	for _, m := range []map[string]string{mainUp, mainDown} {
+		for key, file := range m {
+			if _, ok := listed[key]; !ok {
+				errs = append(errs, fmt.Sprintf("ERROR: %s is not listed in %s", file, OrderFile))
+			}
+		}
+	}
+	sort.Strings(errs)
+	return errs
+}
+
+// compares versions like 0.0.10 and 0.0.9 by numeric parts
+func compareVersions(a, b string) int {
+	aParts := strings.FieldsFunc(a, func(r rune) bool { return r == '.' || r == '~' })
+	bParts := strings.FieldsFunc(b, func(r rune) bool { return r == '.' || r == '~' })
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		an, aErr := strconv.Atoi(aParts[i])
+		bn, bErr := strconv.Atoi(bParts[i])
+		if aErr == nil && bErr == nil {
+			if an != bn {
+				return an - bn
+			}
+			continue
+		}
+		if c := strings.Compare(aParts[i], bParts[i]); c != 0 {
+			return c
+		}
+	}
+	return len(aParts) - len(bParts)
+}
+
+// orderedKeys returns catalog keys in apply order: ORDER file if it exists,
+// otherwise by version, release and number of project-version-release-N
+func orderedKeys(mainUp, mainDown map[string]string) ([]string, error) {
+	order, err := readOrder(MigrationDir)
+	if err != nil {
+		return nil, err
+	}
+	if order != nil {
+		return order, nil
+	}
+	return sortKeys(mainUp, mainDown), nil
+}
+
+// sqlKeys returns keys without Go migrations, they have no scripts for render, export and package
+func sqlKeys(keys []string) []string {
+	var result []string
+	for _, key := range keys {
+		if _, ok := goMigrations[key]; ok {
+			fmt.Printf("skipped %s (Go migration)\n", key)
+			continue
+		}
+		result = append(result, key)
+	}
+	return result
+}
+
+// sortKeys returns keys by version, release and number of project-version-release-N
+func sortKeys(mainUp, mainDown map[string]string) []string {
+	seen := make(map[string]struct{})
+	keys := []string{}
+	for _, m := range []map[string]string{mainUp, mainDown} {
+		for key := range m {
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		baseI, numI, _, okI := parseMigrationKey(keys[i])
+		baseJ, numJ, _, okJ := parseMigrationKey(keys[j])
+		if !okI || !okJ {
+			return keys[i] < keys[j]
+		}
+		if baseI != baseJ {
+			mi := seriesPattern.FindStringSubmatch(baseI)
+			mj := seriesPattern.FindStringSubmatch(baseJ)
+			if mi == nil || mj == nil || mi[1] != mj[1] {
+				return baseI < baseJ
+			}
+			if c := compareVersions(mi[2], mj[2]); c != 0 {
+				return c < 0
+			}
+			ri, _ := strconv.Atoi(mi[3])
+			rj, _ := strconv.Atoi(mj[3])
+			return ri < rj
+		}
+		if numI != numJ {
+			return numI < numJ
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// keysRange returns ordered keys from..to inclusive
+func keysRange(keys []string, from, to string) ([]string, error) {
+	start, end := -1, -1
+	for i, key := range keys {
+		if key == from {
+			start = i
+		}
+		if key == to {
+			end = i
+		}
+	}
+	if start < 0 {
+		return nil, fmt.Errorf("migration %s not found", from)
+	}
+	if end < 0 {
+		return nil, fmt.Errorf("migration %s not found", to)
+	}
+	if start > end {
+		return nil, fmt.Errorf("migration %s is after %s", from, to)
+	}
+	return keys[start : end+1], nil
+}
+
+// inlineIncludes returns script with @include lines replaced by included files, resolved as in findIncludes,
+// stack is a chain of including files to detect loops
+func inlineIncludes(read func(string) ([]byte, error), filePath string, stack []string) (string, error) {
+	for _, f := range stack {
+		if f == filePath {
+			return "", fmt.Errorf("include loop %s -> %s", strings.Join(stack, " -> "), filePath)
+		}
+	}
+	stack = append(stack, filePath)
+	content, err := read(filePath)
+	if err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		inc, ok := parseIncludeLine(line)
+		if !ok || inc == "" {
+			out.WriteString(line)
+			continue
+		}
+		if !strings.HasSuffix(inc, ".sql") {
+			return "", fmt.Errorf("wrong include @%s in %s", inc, filePath)
+		}
+		incPath := filepath.Join(filepath.Dir(filePath), inc)
+		inlined, err := inlineIncludes(read, incPath, stack)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&out, "# >>> include @%s (%s)\n", inc, filepath.ToSlash(incPath))
+		out.WriteString(inlined)
+		if !strings.HasSuffix(inlined, "\n") {
+			out.WriteString("\n")
+		}
+		fmt.Fprintf(&out, "# <<< include @%s\n", inc)
+	}
+	return out.String(), nil
+}
+
+func reversed(keys []string) []string {
+	result := make([]string, 0, len(keys))
+	for i := len(keys) - 1; i >= 0; i-- {
+		result = append(result, keys[i])
+	}
+	return result
+}
+
+// renders migrations scripts in given order into one script
+func renderScripts(read func(string) ([]byte, error), files []string) (string, error) {
+	var out strings.Builder
+	for _, file := range files {
+		inlined, err := inlineIncludes(read, file, nil)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&out, "# === %s (%s)\n", filepath.Base(file), filepath.ToSlash(file))
+		out.WriteString(inlined)
+		if !strings.HasSuffix(inlined, "\n") {
+			out.WriteString("\n")
+		}
+	}
+	return out.String(), nil
+}
+
+// render writes self-contained up and down scripts of migrations from..to, down script is in reverse order
+func render(from, to, outDir string) error {
+	mainUp, mainDown, err := findMigrationFiles(MigrationDir)
+	if err != nil {
+		return err
+	}
+	keys, err := orderedKeys(mainUp, mainDown)
+	if err != nil {
+		return err
+	}
+	selected, err := keysRange(keys, from, to)
+	if err != nil {
+		return err
+	}
+	if selected = sqlKeys(selected); len(selected) == 0 {
+		return fmt.Errorf("no migrations with scripts, Go migrations are run by apply only")
+	}
+	name := from
+	if from != to {
+		name = from + ".." + to
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+	for _, direction := range []string{"up", "down"} {
+		scripts, ordered := mainUp, selected
+		if direction == "down" {
+			scripts, ordered = mainDown, reversed(selected)
+		}
+		var files []string
+		for _, key := range ordered {
+			file, ok := scripts[key]
+			if !ok {
+				return fmt.Errorf("%s has no %s script", key, direction)
+			}
+			files = append(files, file)
+		}
+		script, err := renderScripts(os.ReadFile, files)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(outDir, name+"."+direction+".sql")
+		if err := os.WriteFile(target, []byte(script), 0644); err != nil {
+			return err
+		}
+		fmt.Println("[ok] rendered", target)
+	}
+	return nil
+}
+
+// catalogSnapshot is catalog at commit or in worktree
+type catalogSnapshot struct {
+	up         map[string]string
+	down       map[string]string
+	repeatable map[string]string
+	callbacks  map[string]string
+	// order is ORDER file content, nil if there is no ORDER file
+	order []string
+	read  func(string) ([]byte, error)
+}
+
+// snapshotAt returns catalog at ref, or worktree catalog if ref is empty
+func snapshotAt(ref string) (catalogSnapshot, error) {
+	if ref == "" {
+		up, down, err := findMigrationFiles(MigrationDir)
+		if err != nil {
+			return catalogSnapshot{}, err
+		}
+		repeatable, err := findRepeatableFiles(MigrationDir)
+		if err != nil {
+			return catalogSnapshot{}, err
+		}
+		callbacks, err := findCallbackFiles(MigrationDir)
+		if err != nil {
+			return catalogSnapshot{}, err
+		}
+		order, err := readOrder(MigrationDir)
+		if err != nil {
+			return catalogSnapshot{}, err
+		}
+		return catalogSnapshot{up: up, down: down, repeatable: repeatable, callbacks: callbacks, order: order, read: os.ReadFile}, nil
+	}
+	catalog := path.Clean(filepath.ToSlash(MigrationDir))
+	tree, err := listTree(ref, catalog)
+	if err != nil {
+		return catalogSnapshot{}, err
+	}
+	snapshot := catalogSnapshot{up: map[string]string{}, down: map[string]string{}, repeatable: map[string]string{}, callbacks: map[string]string{}}
+	snapshot.read = func(file string) ([]byte, error) {
+		entry, ok := tree[path.Clean(filepath.ToSlash(file))]
+		if !ok {
+			return nil, fmt.Errorf("%s not found at %s: %w", file, ref, os.ErrNotExist)
+		}
+		content, err := readBlob(entry.object)
+		return []byte(content), err
+	}
+	up, down := findTreeMigrationFiles(tree, catalog)
+	for key, entry := range up {
+		snapshot.up[key] = entry.path
+	}
+	for key, entry := range down {
+		snapshot.down[key] = entry.path
+	}
+	for name, entry := range findTreeRepeatableFiles(tree, catalog) {
+		snapshot.repeatable[name] = entry.path
+	}
+	for name, entry := range findTreeCallbackFiles(tree, catalog) {
+		snapshot.callbacks[name] = entry.path
+	}
+	if _, ok := tree[catalog+"/"+OrderFile]; ok {
+		content, err := snapshot.read(catalog + "/" + OrderFile)
+		if err != nil {
+			return catalogSnapshot{}, err
+		}
+		snapshot.order = []string{}
+		for _, line := range strings.Split(string(content), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				snapshot.order = append(snapshot.order, line)
+			}
+		}
+	}
+	return snapshot, nil
+}
+
+func (c catalogSnapshot) keys() []string {
+	if c.order != nil {
+		return c.order
+	}
+	return sortKeys(c.up, c.down)
+}
+
+func sqlQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// changedRepeatables returns sorted names of repeatable scripts of target which are not at installed
+// or have other content, and their target checksums
+func changedRepeatables(installed, target catalogSnapshot) ([]string, map[string]string, error) {
+	var names []string
+	checksums := make(map[string]string)
+	for name, file := range target.repeatable {
+		content, err := target.read(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		checksums[name] = bodyChecksum(content)
+		if installedFile, ok := installed.repeatable[name]; ok {
+			installedContent, err := installed.read(installedFile)
+			if err != nil {
+				return nil, nil, err
+			}
+			if bodyChecksum(installedContent) == checksums[name] {
+				continue
+			}
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, checksums, nil
+}
+
+// writeCallbacks renders callbacks of event of snapshot into out
+func writeCallbacks(out *strings.Builder, snapshot catalogSnapshot, event string) error {
+	script, err := renderScripts(snapshot.read, callbackFiles(snapshot.callbacks, event))
+	if err != nil {
+		return err
+	}
+	out.WriteString(script)
+	return nil
+}
+
+// bundle writes up script from release from to release to and down script back,
+// migrations are those which are at to and are not at from,
+// repeatable scripts changed between from and to are run after them,
+// callbacks of to are run around scripts: *Migrate ones in up script, *Rollback ones in down script
+func bundle(from, to, outDir string) error {
+	target, err := snapshotAt(to)
+	if err != nil {
+		return err
+	}
+	installed := catalogSnapshot{up: map[string]string{}, down: map[string]string{}, repeatable: map[string]string{}}
+	if from != "" {
+		if installed, err = snapshotAt(from); err != nil {
+			return err
+		}
+	}
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	history := config.historyTable()
+
+	var keys []string
+	for _, key := range target.keys() {
+		_, upInstalled := installed.up[key]
+		_, downInstalled := installed.down[key]
+		if !upInstalled && !downInstalled {
+			keys = append(keys, key)
+		}
+	}
+	repeatables, repeatableChecksums, err := changedRepeatables(installed, target)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 && len(repeatables) == 0 {
+		return fmt.Errorf("no migrations between %s and %s", from, to)
+	}
+	fromName, toName := from, to
+	if fromName == "" {
+		fromName = "empty"
+	}
+	if toName == "" {
+		toName = "current"
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+
+	var header strings.Builder
+	header.WriteString("################################################################################\n")
+	fmt.Fprintf(&header, "## bundle %s..%s\n## migrations:\n", fromName, toName)
+	checksums := make(map[string]string)
+	for _, key := range keys {
+		if _, ok := goMigrations[key]; ok {
+			return fmt.Errorf("%s is Go migration, it is run by apply only", key)
+		}
+		file, ok := target.up[key]
+		if !ok {
+			return fmt.Errorf("%s has no up script", key)
+		}
+		if _, ok := target.down[key]; !ok {
+			return fmt.Errorf("%s has no down script", key)
+		}
+		content, err := target.read(file)
+		if err != nil {
+			return err
+		}
+		checksums[key] = contentChecksum("sha256", content)
+		fmt.Fprintf(&header, "##   %s sha256:%s\n", key, checksums[key])
+	}
+	if len(repeatables) > 0 {
+		header.WriteString("## repeatable:\n")
+	}
+	for _, name := range repeatables {
+		fmt.Fprintf(&header, "##   %s sha256:%s\n", name, repeatableChecksums[name])
+	}
+	var callbackNames []string
+	for name := range target.callbacks {
+		callbackNames = append(callbackNames, name)
+	}
+	sort.Strings(callbackNames)
+	if len(callbackNames) > 0 {
+		fmt.Fprintf(&header, "## callbacks: %s\n", strings.Join(callbackNames, " "))
+	}
+	header.WriteString("################################################################################\n")
+
+	for _, direction := range []string{"up", "down"} {
+		scripts, ordered, event := target.up, keys, "Migrate"
+		if direction == "down" {
+			scripts, ordered, event = target.down, reversed(keys), "Rollback"
+		}
+		var out strings.Builder
+		out.WriteString(header.String())
+		fmt.Fprintf(&out, "## %s script\n", direction)
+		if direction == "up" && from == "" {
+			if config.Dialect == "oracle" {
+				// PL/SQL block ends with '/' line
+				fmt.Fprintf(&out, "%s\n/\n", historyDDL(history, config.Dialect))
+			} else {
+				fmt.Fprintf(&out, "%s;\n", historyDDL(history, config.Dialect))
+			}
+		}
+		if err := writeCallbacks(&out, target, "before"+event); err != nil {
+			return err
+		}
+		// repeatable scripts run after migrations, on down previous versions are restored first
+		if direction == "down" {
+			for _, name := range repeatables {
+				if err := writeCallbacks(&out, target, "beforeEach"+event); err != nil {
+					return err
+				}
+				file, ok := installed.repeatable[name]
+				if !ok {
+					fmt.Fprintf(&out, "## %s is not at %s, its objects are left as is\n", name, fromName)
+					fmt.Fprintf(&out, "delete from %s where migration = %s;\n", history, sqlQuote(name))
+				} else {
+					content, err := installed.read(file)
+					if err != nil {
+						return err
+					}
+					script, err := renderScripts(installed.read, []string{file})
+					if err != nil {
+						return err
+					}
+					out.WriteString(script)
+					fmt.Fprintf(&out, "update %s set checksum = %s, applied_at = current_timestamp where migration = %s;\n",
+						history, sqlQuote("sha256:"+bodyChecksum(content)), sqlQuote(name))
+				}
+				if err := writeCallbacks(&out, target, "afterEach"+event); err != nil {
+					return err
+				}
+			}
+		}
+		for _, key := range ordered {
+			if err := writeCallbacks(&out, target, "beforeEach"+event); err != nil {
+				return err
+			}
+			script, err := renderScripts(target.read, []string{scripts[key]})
+			if err != nil {
+				return err
+			}
+			out.WriteString(script)
+			if direction == "up" {
+				fmt.Fprintf(&out, "insert into %s (migration, checksum, applied_at) values (%s, %s, current_timestamp);\n",
+					history, sqlQuote(key), sqlQuote("sha256:"+checksums[key]))
+			} else {
+				fmt.Fprintf(&out, "delete from %s where migration = %s;\n", history, sqlQuote(key))
+			}
+			if err := writeCallbacks(&out, target, "afterEach"+event); err != nil {
+				return err
+			}
+		}
+		if direction == "up" {
+			for _, name := range repeatables {
+				if err := writeCallbacks(&out, target, "beforeEach"+event); err != nil {
+					return err
+				}
+				script, err := renderScripts(target.read, []string{target.repeatable[name]})
+				if err != nil {
+					return err
+				}
+				out.WriteString(script)
+				fmt.Fprintf(&out, "delete from %s where migration = %s;\n", history, sqlQuote(name))
+				fmt.Fprintf(&out, "insert into %s (migration, checksum, applied_at) values (%s, %s, current_timestamp);\n",
+					history, sqlQuote(name), sqlQuote("sha256:"+repeatableChecksums[name]))
+				if err := writeCallbacks(&out, target, "afterEach"+event); err != nil {
+					return err
+				}
+			}
+		}
+		if err := writeCallbacks(&out, target, "after"+event); err != nil {
+			return err
+		}
+		outFile := filepath.Join(outDir, fmt.Sprintf("%s..%s.%s.sql", fromName, toName, direction))
+		if err := os.WriteFile(outFile, []byte(out.String()), 0644); err != nil {
+			return err
+		}
+		fmt.Println("[ok] written", outFile)
+	}
+	return nil
+}
+
+// PackageManifest is manifest.json of migrations package
+type PackageManifest struct {
+	Project string `json:"project"`
+	Version string `json:"version"`
+	Release string `json:"release"`
+	// Migrations are catalog keys in apply order
+	Migrations []string `json:"migrations"`
+	// GoMigrations are keys of Migrations registered by Register, they have no scripts in archive
+	GoMigrations []string   `json:"go_migrations,omitempty"`
+	Files        []LockFile `json:"files"`
+}
+
+// packageMigrations writes reproducible archive of catalog: sorted entries, owner root,
+// modification time SOURCE_DATE_EPOCH or zero
+func packageMigrations(outDir string) error {
+	manifest := PackageManifest{}
+	var err error
+	if manifest.Project, err = describe("project"); err != nil {
+		return err
+	}
+	if manifest.Version, err = describe("version"); err != nil {
+		return err
+	}
+	if manifest.Release, err = describe("release"); err != nil {
+		return err
+	}
+	mainUp, mainDown, err := findMigrationFiles(MigrationDir)
+	if err != nil {
+		return err
+	}
+	if manifest.Migrations, err = orderedKeys(mainUp, mainDown); err != nil {
+		return err
+	}
+	for _, key := range manifest.Migrations {
+		if _, ok := goMigrations[key]; ok {
+			manifest.GoMigrations = append(manifest.GoMigrations, key)
+		}
+	}
+
+	var files []string
+	err = filepath.Walk(MigrationDir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	contents := make(map[string][]byte)
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		name := path.Clean(filepath.ToSlash(file))
+		contents[name] = content
+		manifest.Files = append(manifest.Files, LockFile{
+			File:   name,
+			SHA256: contentChecksum("sha256", content),
+			Source: parseMigrationMetaContent(string(content)).source,
+		})
+	}
+	manifestContent, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	modTime := time.Unix(0, 0)
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		modTime = time.Unix(epoch, 0)
+	}
+	name := fmt.Sprintf("%s-%s-%s-migrations", manifest.Project, manifest.Version, manifest.Release)
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+	archive := filepath.Join(outDir, name+".tar.gz")
+	f, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	write := func(file string, content []byte) error {
+		header := &tar.Header{
+			Name:    name + "/" + file,
+			Mode:    0644,
+			Size:    int64(len(content)),
+			ModTime: modTime,
+			Format:  tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := tw.Write(content)
+		return err
+	}
+	if err := write("manifest.json", append(manifestContent, '\n')); err != nil {
+		return err
+	}
+	for _, file := range manifest.Files {
+		if err := write(file.File, contents[file.File]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Println("[ok] packaged", archive)
+	return nil
+}
+
+// verifyPackage checks archive files against its manifest.json
+func verifyPackage(archive string) {
+	f, err := os.Open(archive)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
+	tr := tar.NewReader(gz)
+	files := make(map[string]string)
+	var manifest *PackageManifest
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		_, name, _ := strings.Cut(header.Name, "/")
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+		if name == "manifest.json" {
+			manifest = &PackageManifest{}
+			if err := json.Unmarshal(content, manifest); err != nil {
+				fmt.Println("ERROR: failed to parse manifest.json:", err)
+				os.Exit(1)
+			}
+			continue
+		}
+		files[name] = contentChecksum("sha256", content)
+	}
+	if manifest == nil {
+		fmt.Printf("ERROR: %s has no manifest.json\n", archive)
+		os.Exit(1)
+	}
+
+	var errs []string
+	listed := make(map[string]struct{})
+	for _, file := range manifest.Files {
+		listed[file.File] = struct{}{}
+		checksum, ok := files[file.File]
+		switch {
+		case !ok:
+			errs = append(errs, fmt.Sprintf("ERROR: %s is missing", file.File))
+		case checksum != file.SHA256:
+			errs = append(errs, fmt.Sprintf("ERROR: %s checksum mismatch", file.File))
+		}
+	}
+	for file := range files {
+		if _, ok := listed[file]; !ok {
+			errs = append(errs, fmt.Sprintf("ERROR: %s is not in manifest", file))
+		}
+	}
+	catalog := path.Clean(filepath.ToSlash(MigrationDir))
+	goKeys := make(map[string]struct{})
+	for _, key := range manifest.GoMigrations {
+		goKeys[key] = struct{}{}
+	}
+	for _, key := range manifest.Migrations {
+		if _, ok := goKeys[key]; ok {
+			continue
+		}
+		for _, suffix := range []string{".up.sql", ".down.sql"} {
+			if _, ok := files[catalog+"/"+key+suffix]; !ok {
+				errs = append(errs, fmt.Sprintf("ERROR: migration %s has no %s", key, suffix))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		for _, e := range errs {
+			fmt.Println(e)
+		}
+		os.Exit(1)
+	}
+	fmt.Printf("[ok] %s-%s-%s: %d migrations, %d files verified\n",
+		manifest.Project, manifest.Version, manifest.Release, len(manifest.Migrations), len(manifest.Files))
+}
+
+var exportNameReplacer = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// exportName converts migration key to name allowed by other tools
+func exportName(key string) string {
+	return strings.Trim(exportNameReplacer.ReplaceAllString(key, "_"), "_")
+}
+
+// isDirective reports whether line is roam-sql directive: connect <source> or whenever error ...,
+// oracle 'connect by' clause is not one
+func isDirective(line string) bool {
+	fields := strings.Fields(strings.ToLower(line))
+	switch {
+	case len(fields) == 2 && fields[0] == "connect":
+		return fields[1] != "by"
+	case len(fields) >= 3 && fields[0] == "whenever":
+		return fields[1] == "error"
+	}
+	return false
+}
+
+// sqlScript returns script with inlined includes, '#' comments and roam-sql directives converted to '--' comments,
+// other tools and databases know neither includes nor '#' comments and directives
+func sqlScript(read func(string) ([]byte, error), file string) (string, error) {
+	inlined, err := inlineIncludes(read, file, nil)
+	if err != nil {
+		return "", err
+	}
+	lines := strings.SplitAfter(inlined, "\n")
+	for i, line := range lines {
+		if isDirective(line) {
+			line = "#" + strings.TrimLeft(line, " \t")
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			comment := strings.TrimPrefix(strings.TrimLeft(line, " \t"), "#")
+			if !strings.HasPrefix(comment, " ") {
+				comment = " " + comment
+			}
+			lines[i] = "--" + comment
+		}
+	}
+	return strings.Join(lines, ""), nil
+}
+
+// liquibase changelog
+type liquibaseChangeLog struct {
+	XMLName        xml.Name             `xml:"databaseChangeLog"`
+	Xmlns          string               `xml:"xmlns,attr"`
+	XmlnsXsi       string               `xml:"xmlns:xsi,attr"`
+	SchemaLocation string               `xml:"xsi:schemaLocation,attr"`
+	ChangeSets     []liquibaseChangeSet `xml:"changeSet"`
+}
+
+type liquibaseChangeSet struct {
+	ID       string           `xml:"id,attr"`
+	Author   string           `xml:"author,attr"`
+	SQLFile  liquibaseSQLFile `xml:"sqlFile"`
+	Rollback liquibaseSQLFile `xml:"rollback>sqlFile"`
+}
+
+type liquibaseSQLFile struct {
+	Path                    string `xml:"path,attr"`
+	RelativeToChangelogFile bool   `xml:"relativeToChangelogFile,attr"`
+	SplitStatements         bool   `xml:"splitStatements,attr"`
+	StripComments           bool   `xml:"stripComments,attr"`
+	EndDelimiter            string `xml:"endDelimiter,attr,omitempty"`
+}
+
+// liquibaseEndDelimiter matches '/' lines which end statements of exported scripts with PL/SQL code
+const liquibaseEndDelimiter = `\n/\s*\n|\n/\s*$`
+
+// hasDelimiterLines reports whether script has '/' lines, roam-sql delimiter of PL/SQL code
+func hasDelimiterLines(script string) bool {
+	for _, line := range strings.Split(script, "\n") {
+		if strings.TrimSpace(line) == "/" {
+			return true
+		}
+	}
+	return false
+}
+
+// exportScript adapts '/' lines of script to format: golang-migrate runs file as a whole and knows no delimiters,
+// liquibase splits by end delimiter which has to be '/' for all statements then, flyway knows '/' lines itself.
+// It returns end delimiter of liquibase if the script needs one
+func exportScript(script, format, dialect string) (string, string) {
+	if !hasDelimiterLines(script) {
+		return script, ""
+	}
+	switch format {
+	case "golang-migrate":
+		lines := strings.SplitAfter(script, "\n")
+		for i, line := range lines {
+			if strings.TrimSpace(line) == "/" {
+				lines[i] = ""
+			}
+		}
+		return strings.Join(lines, ""), ""
+	case "liquibase":
+		return strings.Join(splitStatements(script, dialect), "\n/\n") + "\n/\n", liquibaseEndDelimiter
+	}
+	return script, ""
+}
+
+// export writes ordered catalog in layout of other migration tool
+func export(format, outDir string) error {
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	// '/' lines are PL/SQL delimiter of roam-sql scripts
+	dialect := config.Dialect
+	if dialect == "" {
+		dialect = "oracle"
+	}
+	mainUp, mainDown, err := findMigrationFiles(MigrationDir)
+	if err != nil {
+		return err
+	}
+	keys, err := orderedKeys(mainUp, mainDown)
+	if err != nil {
+		return err
+	}
+	keys = sqlKeys(keys)
+	var upName, downName func(n int, name string) string
+	switch format {
+	case "golang-migrate":
+		upName = func(n int, name string) string { return fmt.Sprintf("%d_%s.up.sql", n, name) }
+		downName = func(n int, name string) string { return fmt.Sprintf("%d_%s.down.sql", n, name) }
+	case "flyway":
+		upName = func(n int, name string) string { return fmt.Sprintf("V%d__%s.sql", n, name) }
+		downName = func(n int, name string) string { return fmt.Sprintf("U%d__%s.sql", n, name) }
+	case "liquibase":
+		upName = func(n int, name string) string { return path.Join("sql", name+".up.sql") }
+		downName = func(n int, name string) string { return path.Join("sql", name+".down.sql") }
+	default:
+		return fmt.Errorf("unknown export format '%s'", format)
+	}
+
+	changeLog := liquibaseChangeLog{
+		Xmlns:          "http://www.liquibase.org/xml/ns/dbchangelog",
+		XmlnsXsi:       "http://www.w3.org/2001/XMLSchema-instance",
+		SchemaLocation: "http://www.liquibase.org/xml/ns/dbchangelog http://www.liquibase.org/xml/ns/dbchangelog/dbchangelog-latest.xsd",
+	}
+	for i, key := range keys {
+		upFile, ok := mainUp[key]
+		if !ok {
+			return fmt.Errorf("%s has no up script", key)
+		}
+		downFile, ok := mainDown[key]
+		if !ok {
+			return fmt.Errorf("%s has no down script", key)
+		}
+		name := exportName(key)
+		var endDelimiters []string
+		for _, file := range [][2]string{{upFile, upName(i+1, name)}, {downFile, downName(i+1, name)}} {
+			script, err := sqlScript(os.ReadFile, file[0])
+			if err != nil {
+				return err
+			}
+			script, endDelimiter := exportScript(script, format, dialect)
+			endDelimiters = append(endDelimiters, endDelimiter)
+			target := filepath.Join(outDir, filepath.FromSlash(file[1]))
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(target, []byte(script), 0644); err != nil {
+				return err
+			}
+		}
+		changeLog.ChangeSets = append(changeLog.ChangeSets, liquibaseChangeSet{
+			ID:       key,
+			Author:   "migration",
+			SQLFile:  liquibaseSQLFile{Path: upName(i+1, name), RelativeToChangelogFile: true, SplitStatements: true, StripComments: true, EndDelimiter: endDelimiters[0]},
+			Rollback: liquibaseSQLFile{Path: downName(i+1, name), RelativeToChangelogFile: true, SplitStatements: true, StripComments: true, EndDelimiter: endDelimiters[1]},
+		})
+	}
+	if format == "liquibase" {
+		content, err := xml.MarshalIndent(changeLog, "", "  ")
+		if err != nil {
+			return err
+		}
+		content = append([]byte(xml.Header), append(content, '\n')...)
+		if err := os.WriteFile(filepath.Join(outDir, "changelog.xml"), content, 0644); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("[ok] exported %d migration(s) to %s\n", len(keys), outDir)
+	return nil
+}
+
+var (
+	golangMigratePattern = regexp.MustCompile(`^(\d+)_(.*)\.(up|down)\.sql$`)
+	flywayPattern        = regexp.MustCompile(`^([VU])([0-9._]+)__(.*)\.sql$`)
+)
+
+// importedMigration is an up and down scripts of other tool
+type importedMigration struct {
+	version     string
+	description string
+	up          string
+	down        string
+}
+
+// reads migrations of golang-migrate or flyway directory ordered by version
+func readImported(format, dir string) ([]*importedMigration, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[string]*importedMigration)
+	get := func(version, description string) *importedMigration {
+		if byVersion[version] == nil {
+			byVersion[version] = &importedMigration{version: version, description: description}
+		}
+		return byVersion[version]
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		file := filepath.Join(dir, name)
+		switch format {
+		case "golang-migrate":
+			matches := golangMigratePattern.FindStringSubmatch(name)
+			if matches == nil {
+				fmt.Printf("skipped %s (not a golang-migrate file)\n", file)
+				continue
+			}
+			m := get(strings.TrimLeft(matches[1], "0"), matches[2])
+			if matches[3] == "up" {
+				m.up = file
+			} else {
+				m.down = file
+			}
+		case "flyway":
+			matches := flywayPattern.FindStringSubmatch(name)
+			if matches == nil {
+				fmt.Printf("skipped %s (not a versioned flyway file)\n", file)
+				continue
+			}
+			m := get(strings.ReplaceAll(matches[2], "_", "."), matches[3])
+			if matches[1] == "V" {
+				m.up = file
+			} else {
+				m.down = file
+			}
+		default:
+			return nil, fmt.Errorf("unknown import format '%s'", format)
+		}
+	}
+	var migrations []*importedMigration
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("version %s has no up script", m.version)
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return compareVersions(migrations[i].version, migrations[j].version) < 0
+	})
+	return migrations, nil
+}
+
+// importMigrations converts migrations of other tool to catalog pairs with meta header of origin,
+// missing down scripts are created as #noop ones, versions which are already imported from the tool are skipped
+func importMigrations(format, dir string) error {
+	migrations, err := readImported(format, dir)
+	if err != nil {
+		return err
+	}
+	project, err := describe("project")
+	if err != nil {
+		return err
+	}
+	version, err := describe("version")
+	if err != nil {
+		return err
+	}
+	release, err := describe("release")
+	if err != nil {
+		return err
+	}
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	baseName := fmt.Sprintf("%s-%s-%s", project, version, release)
+
+	mainUp, _, err := findMigrationFiles(MigrationDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// imported versions by tool
+	imported := make(map[[2]string]struct{})
+	for _, file := range mainUp {
+		if meta := parseMigrationMeta(file); meta.origin != "" {
+			imported[[2]string{meta.origin, meta.originVersion}] = struct{}{}
+		}
+	}
+	if err := os.MkdirAll(MigrationDir, 0755); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	count := 0
+	for _, m := range migrations {
+		if _, ok := imported[[2]string{format, m.version}]; ok {
+			continue
+		}
+		number, err := nextMigrationNumber(config.Naming, MigrationDir, baseName, now.Add(time.Duration(count)*time.Second))
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%s-%d", baseName, number)
+		if suffix := migrationSuffix(m.description); suffix != "" {
+			key += "_" + suffix
+		}
+		meta := migrationMeta{origin: format, originFile: filepath.Base(m.up), originVersion: m.version}
+		if err := copyFileWithMeta(m.up, filepath.Join(MigrationDir, key+".up.sql"), meta); err != nil {
+			return err
+		}
+		downPath := filepath.Join(MigrationDir, key+".down.sql")
+		if m.down != "" {
+			meta.originFile = filepath.Base(m.down)
+			err = copyFileWithMeta(m.down, downPath, meta)
+		} else {
+			err = os.WriteFile(downPath, []byte(fmt.Sprintf("# %s.down.sql\n#noop imported from %s without down script\n", key, format)), 0644)
+		}
+		if err != nil {
+			return err
+		}
+		if config.Naming == "order" {
+			if err := appendOrder(MigrationDir, key); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("imported %s as %s\n", m.up, key)
+		count++
+	}
+	fmt.Printf("[ok] imported %d migration(s)\n", count)
+	if count == 0 {
+		return nil
+	}
+	if err := refreshLock(MigrationDir); err != nil {
+		return fmt.Errorf("failed to write lock file: %v", err)
+	}
+	return nil
+}
+
+// MigrationFunc is up or down of Go migration, it runs in transaction of apply or rollback
+type MigrationFunc func(ctx context.Context, tx *sql.Tx) error
+
+type goMigration struct {
+	up   MigrationFunc
+	down MigrationFunc
+}
+
+// goMigrations are migrations registered by Register
+var goMigrations = make(map[string]goMigration)
+
+// Register adds Go migration with catalog key project-version-release-N[_suffix],
+// it is called from init and panics on wrong or repeated key
+func Register(key string, up, down MigrationFunc) {
+	if _, _, _, ok := parseMigrationKey(key); !ok {
+		panic(fmt.Sprintf("migration: Register of wrong key %q", key))
+	}
+	if up == nil || down == nil {
+		panic("migration: Register of nil function for " + key)
+	}
+	if _, ok := goMigrations[key]; ok {
+		panic("migration: Register called twice for " + key)
+	}
+	goMigrations[key] = goMigration{up: up, down: down}
+}
+
+// dbOptions are database flags of apply, rollback, status and unlock
+type dbOptions struct {
+	driver      string
+	dsn         string
+	lockTimeout time.Duration
+}
+
+func dbFlags(fs *flag.FlagSet) *dbOptions {
+	opts := &dbOptions{}
+	fs.StringVar(&opts.driver, "driver", "", "database/sql driver")
+	fs.StringVar(&opts.dsn, "dsn", "", "data source name")
+	return opts
+}
+
+// openDB opens database of flags, MIGRATION_DSN or config
+func openDB(opts dbOptions, config Config) (*sql.DB, error) {
+	if opts.driver == "" {
+		opts.driver = config.Driver
+	}
+	if opts.dsn == "" {
+		opts.dsn = os.Getenv("MIGRATION_DSN")
+	}
+	if opts.dsn == "" {
+		opts.dsn = config.DSN
+	}
+	if opts.driver == "" {
+		return nil, fmt.Errorf("database driver is not set, use --driver or \"driver\" of %s", ConfigPath)
+	}
+	db, err := sql.Open(opts.driver, opts.dsn)
+	if err != nil {
+		drivers := strings.Join(sql.Drivers(), ", ")
+		if drivers == "" {
+			drivers = "none"
+		}
+		return nil, fmt.Errorf("%v, built in drivers: %s", err, drivers)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// historyEntry is a row of history table
+type historyEntry struct {
+	checksum  string
+	appliedAt string
+}
+
+// ensureHistory creates history table of bundle scripts if it does not exist
+// createTable returns statement which creates table if it does not exist, oracle before 23ai
+// has no 'if not exists', there it is PL/SQL block ignoring ORA-00955 (name is already used)
+func createTable(table, columns, dialect string) string {
+	if dialect == "oracle" {
+		ddl := fmt.Sprintf("create table %s (%s)", table, columns)
+		return fmt.Sprintf("begin\n  execute immediate %s;\nexception\n  when others then\n    if sqlcode != -955 then\n      raise;\n    end if;\nend;", sqlQuote(ddl))
+	}
+	return fmt.Sprintf("create table if not exists %s (%s)", table, columns)
+}
+
+// historyDDL creates history table if it does not exist, it is run by apply and bundle from empty database
+func historyDDL(table, dialect string) string {
+	return createTable(table, "migration varchar(255) primary key, checksum varchar(80) not null, applied_at timestamp not null", dialect)
+}
+
+func ensureHistory(ctx context.Context, db *sql.DB, table, dialect string) error {
+	_, err := db.ExecContext(ctx, historyDDL(table, dialect))
+	return err
+}
+
+func readHistory(ctx context.Context, db *sql.DB, table string) (map[string]historyEntry, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("select migration, checksum, applied_at from %s", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[string]historyEntry)
+	for rows.Next() {
+		var key string
+		var entry historyEntry
+		if err := rows.Scan(&key, &entry.checksum, &entry.appliedAt); err != nil {
+			return nil, err
+		}
+		applied[key] = entry
+	}
+	return applied, rows.Err()
+}
+
+// applyKeys returns keys of catalog and Go migrations in apply order
+func (c catalogSnapshot) applyKeys() []string {
+	if c.order != nil {
+		return c.order
+	}
+	up := make(map[string]string, len(c.up)+len(goMigrations))
+	for key, file := range c.up {
+		up[key] = file
+	}
+	for key := range goMigrations {
+		up[key] = ""
+	}
+	return sortKeys(up, c.down)
+}
+
+// execer is *sql.DB or *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// inTx runs fn in transaction, it is rolled back if fn fails
+func inTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// runCallbacks runs callbacks of event outside of migration transactions by their #transaction mode
+func runCallbacks(ctx context.Context, db *sql.DB, catalog catalogSnapshot, event, dialect string) error {
+	for _, file := range callbackFiles(catalog.callbacks, event) {
+		if err := runScript(ctx, db, catalog.read, file, dialect, nil); err != nil {
+			return fmt.Errorf("callback %s: %v", filepath.Base(file), err)
+		}
+	}
+	return nil
+}
+
+// migrationChecksum returns checksum of up script of key for history table
+func migrationChecksum(catalog catalogSnapshot, key string) (string, error) {
+	if _, ok := goMigrations[key]; ok {
+		return "go", nil
+	}
+	file, ok := catalog.up[key]
+	if !ok {
+		return "", fmt.Errorf("%s has no up script", key)
+	}
+	content, err := catalog.read(file)
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + contentChecksum("sha256", content), nil
+}
+
+// runMigration runs up or down of key with record statements of history table,
+// Go migrations run in one transaction with record
+func runMigration(ctx context.Context, db *sql.DB, catalog catalogSnapshot, key, direction, dialect string, record ...string) error {
+	if m, ok := goMigrations[key]; ok {
+		fn := m.up
+		if direction == "down" {
+			fn = m.down
+		}
+		return inTx(ctx, db, func(tx *sql.Tx) error {
+			if err := fn(ctx, tx); err != nil {
+				return err
+			}
+			return execAll(ctx, tx, record)
+		})
+	}
+	scripts := catalog.up
+	if direction == "down" {
+		scripts = catalog.down
+	}
+	file, ok := scripts[key]
+	if !ok {
+		return fmt.Errorf("%s has no %s script", key, direction)
+	}
+	return runScript(ctx, db, catalog.read, file, dialect, record)
+}
+
+func execAll(ctx context.Context, db execer, statements []string) error {
+	for _, statement := range statements {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runScript runs statements of script with inlined includes by its #transaction mode and record statements of history table:
+// per-file runs statements and record in one transaction, per-statement runs each statement in own transaction
+// and record with last one, off runs statements and record without transaction.
+// Failed statement is rolled back with its transaction, statements before it stay committed if mode is not per-file
+func runScript(ctx context.Context, db *sql.DB, read func(string) ([]byte, error), file, dialect string, record []string) error {
+	content, err := read(file)
+	if err != nil {
+		return err
+	}
+	mode, err := transactionMode(string(content))
+	if err != nil {
+		return err
+	}
+	script, err := sqlScript(read, file)
+	if err != nil {
+		return err
+	}
+	statements := splitStatements(script, dialect)
+	if mode == "per-file" {
+		return inTx(ctx, db, func(tx *sql.Tx) error {
+			for i, statement := range statements {
+				if _, err := tx.ExecContext(ctx, statement); err != nil {
+					return fmt.Errorf("statement %d of %d failed, script is rolled back: %v", i+1, len(statements), err)
+				}
+			}
+			return execAll(ctx, tx, record)
+		})
+	}
+	for i, statement := range statements {
+		last := i == len(statements)-1
+		if mode == "per-statement" {
+			err = inTx(ctx, db, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, statement); err != nil {
+					return err
+				}
+				if last {
+					return execAll(ctx, tx, record)
+				}
+				return nil
+			})
+		} else {
+			_, err = db.ExecContext(ctx, statement)
+		}
+		if err != nil {
+			return fmt.Errorf("statement %d of %d failed, %d statement(s) before it stay applied (#transaction %s): %v", i+1, len(statements), i, mode, err)
+		}
+	}
+	if mode == "off" || len(statements) == 0 {
+		return execAll(ctx, db, record)
+	}
+	return nil
+}
+
+// apply runs pending migrations in apply order, each in own transaction with its history row,
+// then changed repeatable scripts, callbacks are run around them as in bundle up script
+func apply(opts dbOptions) error {
+	ctx := context.Background()
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	catalog, err := snapshotAt("")
+	if err != nil {
+		return err
+	}
+	db, err := openDB(opts, config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	history := config.historyTable()
+	if err := ensureHistory(ctx, db, history, config.Dialect); err != nil {
+		return err
+	}
+	lock, err := acquireLock(ctx, db, config, opts.lockTimeout)
+	if err != nil {
+		return err
+	}
+	defer lock.release(ctx, db)
+	applied, err := readHistory(ctx, db, history)
+	if err != nil {
+		return err
+	}
+
+	var pending []string
+	for _, key := range catalog.applyKeys() {
+		if _, ok := applied[key]; !ok {
+			pending = append(pending, key)
+		}
+	}
+	var repeatables []string
+	checksums := make(map[string]string)
+	for name, file := range catalog.repeatable {
+		content, err := catalog.read(file)
+		if err != nil {
+			return err
+		}
+		checksums[name] = "sha256:" + bodyChecksum(content)
+		if applied[name].checksum != checksums[name] {
+			repeatables = append(repeatables, name)
+		}
+	}
+	sort.Strings(repeatables)
+	if len(pending) == 0 && len(repeatables) == 0 {
+		fmt.Println("[ok] database is up to date")
+		return nil
+	}
+
+	if err := runCallbacks(ctx, db, catalog, "beforeMigrate", config.Dialect); err != nil {
+		return err
+	}
+	for _, key := range pending {
+		if err := runCallbacks(ctx, db, catalog, "beforeEachMigrate", config.Dialect); err != nil {
+			return err
+		}
+		checksum, err := migrationChecksum(catalog, key)
+		if err != nil {
+			return err
+		}
+		err = runMigration(ctx, db, catalog, key, "up", config.Dialect,
+			fmt.Sprintf("insert into %s (migration, checksum, applied_at) values (%s, %s, current_timestamp)", history, sqlQuote(key), sqlQuote(checksum)))
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		fmt.Println("applied", key)
+		if err := runCallbacks(ctx, db, catalog, "afterEachMigrate", config.Dialect); err != nil {
+			return err
+		}
+	}
+	for _, name := range repeatables {
+		if err := runCallbacks(ctx, db, catalog, "beforeEachMigrate", config.Dialect); err != nil {
+			return err
+		}
+		err := runScript(ctx, db, catalog.read, catalog.repeatable[name], config.Dialect, []string{
+			fmt.Sprintf("delete from %s where migration = %s", history, sqlQuote(name)),
+			fmt.Sprintf("insert into %s (migration, checksum, applied_at) values (%s, %s, current_timestamp)", history, sqlQuote(name), sqlQuote(checksums[name])),
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		fmt.Println("applied", name)
+		if err := runCallbacks(ctx, db, catalog, "afterEachMigrate", config.Dialect); err != nil {
+			return err
+		}
+	}
+	if err := runCallbacks(ctx, db, catalog, "afterMigrate", config.Dialect); err != nil {
+		return err
+	}
+	fmt.Printf("[ok] applied %d migration(s)\n", len(pending)+len(repeatables))
+	return nil
+}
+
+// rollback runs down scripts of count last applied migrations of apply order
+func rollback(opts dbOptions, count int) error {
+	ctx := context.Background()
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	catalog, err := snapshotAt("")
+	if err != nil {
+		return err
+	}
+	db, err := openDB(opts, config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	history := config.historyTable()
+	if err := ensureHistory(ctx, db, history, config.Dialect); err != nil {
+		return err
+	}
+	lock, err := acquireLock(ctx, db, config, opts.lockTimeout)
+	if err != nil {
+		return err
+	}
+	defer lock.release(ctx, db)
+	applied, err := readHistory(ctx, db, history)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for _, key := range reversed(catalog.applyKeys()) {
+		if _, ok := applied[key]; ok && len(keys) < count {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		fmt.Println("[ok] nothing to roll back")
+		return nil
+	}
+
+	if err := runCallbacks(ctx, db, catalog, "beforeRollback", config.Dialect); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := runCallbacks(ctx, db, catalog, "beforeEachRollback", config.Dialect); err != nil {
+			return err
+		}
+		err := runMigration(ctx, db, catalog, key, "down", config.Dialect,
+			fmt.Sprintf("delete from %s where migration = %s", history, sqlQuote(key)))
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		fmt.Println("rolled back", key)
+		if err := runCallbacks(ctx, db, catalog, "afterEachRollback", config.Dialect); err != nil {
+			return err
+		}
+	}
+	if err := runCallbacks(ctx, db, catalog, "afterRollback", config.Dialect); err != nil {
+		return err
+	}
+	fmt.Printf("[ok] rolled back %d migration(s)\n", len(keys))
+	return nil
+}
+
+// status prints migrations in apply order and repeatable scripts with their state in database,
+// history rows of keys which are not in catalog are printed last
+func status(opts dbOptions) error {
+	ctx := context.Background()
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	catalog, err := snapshotAt("")
+	if err != nil {
+		return err
+	}
+	db, err := openDB(opts, config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	history := config.historyTable()
+	if err := ensureHistory(ctx, db, history, config.Dialect); err != nil {
+		return err
+	}
+	applied, err := readHistory(ctx, db, history)
+	if err != nil {
+		return err
+	}
+	if row, found, err := readLockRow(ctx, db, config.historyTable()+"_lock", config.Dialect); err == nil && found {
+		fmt.Println(row)
+	}
+
+	known := make(map[string]struct{})
+	done, pending := 0, 0
+	printState := func(state, key, kind string) {
+		fmt.Printf("%-8s %-25s %s%s\n", state, applied[key].appliedAt, key, kind)
+	}
+	for _, key := range catalog.applyKeys() {
+		known[key] = struct{}{}
+		kind := ""
+		if _, ok := goMigrations[key]; ok {
+			kind = " (go)"
+		}
+		if _, ok := applied[key]; ok {
+			printState("applied", key, kind)
+			done++
+		} else {
+			printState("pending", key, kind)
+			pending++
+		}
+	}
+	var names []string
+	for name := range catalog.repeatable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		known[name] = struct{}{}
+		content, err := catalog.read(catalog.repeatable[name])
+		if err != nil {
+			return err
+		}
+		entry, ok := applied[name]
+		switch {
+		case !ok:
+			printState("pending", name, " (repeatable)")
+			pending++
+		case entry.checksum != "sha256:"+bodyChecksum(content):
+			printState("changed", name, " (repeatable)")
+			pending++
+		default:
+			printState("applied", name, " (repeatable)")
+			done++
+		}
+	}
+	var unknown []string
+	for key := range applied {
+		if _, ok := known[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		printState("missing", key, " (not in catalog)")
+	}
+	if len(unknown) > 0 {
+		fmt.Printf("[ok] %d applied, %d pending, %d not in catalog\n", done, pending, len(unknown))
+		return nil
+	}
+	fmt.Printf("[ok] %d applied, %d pending\n", done, pending)
+	return nil
+}
+
+var (
+	plsqlPattern     = regexp.MustCompile(`(?is)^(\s*--[^\n]*\n)*\s*(declare|begin|create\s+(or\s+replace\s+)?((non)?editionable\s+)?(procedure|function|package|trigger|type))\b`)
+	dollarTagPattern = regexp.MustCompile(`^\$[A-Za-z_0-9]*\$`)
+	// statements which can not run in transaction block
+	noTransactionPatterns = map[string]*regexp.Regexp{
+		"postgres": regexp.MustCompile(`(?i)^\s*((create|drop)\s+(unique\s+)?index\s+concurrently|reindex\b.*\bconcurrently|vacuum|(create|drop)\s+(database|tablespace)|alter\s+system)\b`),
+		"sqlite":   regexp.MustCompile(`(?i)^\s*vacuum\b`),
+	}
+	// dialects where DDL commits transaction implicitly
+	implicitCommitDialects = map[string]bool{"mysql": true, "oracle": true}
+)
+
+// transactionMode returns mode of #transaction line of script, per-file if there is none
+func transactionMode(content string) (string, error) {
+	mode := ""
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "#transaction" {
+			continue
+		}
+		if mode != "" {
+			return "", fmt.Errorf("#transaction is given more than once")
+		}
+		if len(fields) != 2 {
+			return "", fmt.Errorf("wrong line '%s', expect #transaction per-file|per-statement|off", strings.TrimSpace(line))
+		}
+		switch fields[1] {
+		case "per-file", "per-statement", "off":
+			mode = fields[1]
+		default:
+			return "", fmt.Errorf("unknown transaction mode '%s', expect per-file, per-statement or off", fields[1])
+		}
+	}
+	if mode == "" {
+		return "per-file", nil
+	}
+	return mode, nil
+}
+
+// splitStatements splits script by ';' outside of quotes and comments, '/' line ends statement too,
+// PL/SQL blocks of oracle dialect end only with '/' line, statements without code are dropped
+func splitStatements(script, dialect string) []string {
+	var statements []string
+	var current strings.Builder
+	flush := func() {
+		if statement := strings.TrimSpace(current.String()); hasStatements(statement) {
+			statements = append(statements, statement)
+		}
+		current.Reset()
+	}
+	// skip returns length of quoted text or comment at i, 0 if there is none
+	skip := func(i int) int {
+		rest := script[i:]
+		var end int
+		switch {
+		case strings.HasPrefix(rest, "--"):
+			end = strings.IndexByte(rest, '\n')
+		case strings.HasPrefix(rest, "/*"):
+			if end = strings.Index(rest[2:], "*/"); end >= 0 {
+				end += 4
+			}
+		case rest[0] == '\'' || rest[0] == '"' || rest[0] == '`':
+			if end = strings.IndexByte(rest[1:], rest[0]); end >= 0 {
+				end += 2
+			}
+		case rest[0] == '$' && dialect == "postgres":
+			tag := dollarTagPattern.FindString(rest)
+			if tag == "" {
+				return 0
+			}
+			if end = strings.Index(rest[len(tag):], tag); end >= 0 {
+				end += 2 * len(tag)
+			}
+		default:
+			return 0
+		}
+		if end < 0 {
+			return len(rest)
+		}
+		return end
+	}
+	for i := 0; i < len(script); {
+		if i == 0 || script[i-1] == '\n' {
+			line, _, _ := strings.Cut(script[i:], "\n")
+			if strings.TrimSpace(line) == "/" {
+				flush()
+				i += len(line)
+				continue
+			}
+		}
+		if n := skip(i); n > 0 {
+			current.WriteString(script[i : i+n])
+			i += n
+			continue
+		}
+		if script[i] == ';' && !(dialect == "oracle" && plsqlPattern.MatchString(current.String())) {
+			flush()
+			i++
+			continue
+		}
+		current.WriteByte(script[i])
+		i++
+	}
+	flush()
+	return statements
+}
+
+// checkTransactions validates #transaction lines of catalog scripts and reports statements which
+// do not fit their transaction in config dialect by rule transaction
+func checkTransactions(catalogs []map[string]string, config Config) ([]string, []string) {
+	var errs, warns []string
+	switch config.Dialect {
+	case "", "postgres", "mysql", "oracle", "sqlite":
+	default:
+		return []string{fmt.Sprintf("unknown dialect '%s' in %s", config.Dialect, ConfigPath)}, nil
+	}
+	report := func(problem string) {
+		switch config.policy("transaction") {
+		case "error":
+			errs = append(errs, problem)
+		case "warning":
+			warns = append(warns, problem)
+		}
+	}
+	for _, files := range catalogs {
+		for _, file := range files {
+			content, err := os.ReadFile(file)
+			if err != nil {
+				continue
+			}
+			mode, err := transactionMode(string(content))
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", file, err))
+				continue
+			}
+			if config.Dialect == "" || config.policy("transaction") == "off" {
+				continue
+			}
+			script, err := sqlScript(os.ReadFile, file)
+			if err != nil {
+				continue
+			}
+			statements := splitStatements(script, config.Dialect)
+			ddl := false
+			for _, statement := range statements {
+				ddl = ddl || hasDDL(statement)
+				pattern := noTransactionPatterns[config.Dialect]
+				if pattern == nil || mode == "off" {
+					continue
+				}
+				for _, line := range strings.Split(statement, "\n") {
+					if pattern.MatchString(line) {
+						report(fmt.Sprintf("%s: '%s' can not run in transaction in %s, use #transaction off", file, strings.TrimSpace(line), config.Dialect))
+						break
+					}
+				}
+			}
+			if mode == "per-file" && implicitCommitDialects[config.Dialect] && ddl && len(statements) > 1 {
+				report(fmt.Sprintf("%s: DDL commits transaction implicitly in %s, per-file transaction is not atomic, use #transaction per-statement or off", file, config.Dialect))
+			}
+		}
+	}
+	sort.Strings(errs)
+	sort.Strings(warns)
+	return errs, warns
+}
+
+// migrationLock is a lock of apply and rollback, advisory lock of session conn for postgres and mysql,
+// otherwise lock row with expiry. Lock row records holder in both cases, its expiry is prolonged while lock is held
+type migrationLock struct {
+	table   string
+	holder  string
+	dialect string
+	ttl     time.Duration
+	conn    *sql.Conn
+	stop    chan struct{}
+	done    sync.WaitGroup
+}
+
+// lockRow is holder record of lock table, it is stale if advisory lock is released or row is expired
+type lockRow struct {
+	holder     string
+	acquiredAt string
+	expiresAt  string
+	stale      bool
+}
+
+func (r lockRow) String() string {
+	if r.stale {
+		return fmt.Sprintf("stale lock of %s since %s, holder is gone", r.holder, r.acquiredAt)
+	}
+	return fmt.Sprintf("locked by %s since %s, expires %s", r.holder, r.acquiredAt, r.expiresAt)
+}
+
+func ensureLockTable(ctx context.Context, db *sql.DB, table, dialect string) error {
+	_, err := db.ExecContext(ctx, createTable(table, "id integer primary key, holder varchar(255) not null, acquired_at timestamp not null, expires_at timestamp not null", dialect))
+	return err
+}
+
+func readLockRow(ctx context.Context, db *sql.DB, table, dialect string) (lockRow, bool, error) {
+	var row lockRow
+	err := db.QueryRowContext(ctx, fmt.Sprintf("select holder, acquired_at, expires_at from %s where id = 1", table)).Scan(&row.holder, &row.acquiredAt, &row.expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return row, false, nil
+	}
+	if err != nil {
+		return row, false, err
+	}
+	var held int
+	switch dialect {
+	case "postgres":
+		err = db.QueryRowContext(ctx, fmt.Sprintf("select count(*) from pg_locks where %s and granted", pgAdvisoryLock(table))).Scan(&held)
+	case "mysql":
+		var id sql.NullInt64
+		err = db.QueryRowContext(ctx, fmt.Sprintf("select is_used_lock(%s)", sqlQuote(table))).Scan(&id)
+		if id.Valid {
+			held = 1
+		}
+	default:
+		err = db.QueryRowContext(ctx, fmt.Sprintf("select count(*) from %s where id = 1 and expires_at >= %s", table, timestampLiteral(time.Now(), dialect))).Scan(&held)
+	}
+	row.stale = held == 0
+	return row, true, err
+}
+
+// lockHolder identifies this run as author@host pid
+func lockHolder() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s@%s pid %d", author(), host, os.Getpid())
+}
+
+func timestampLiteral(t time.Time, dialect string) string {
+	literal := sqlQuote(t.UTC().Format("2006-01-02 15:04:05"))
+	if dialect == "oracle" {
+		return "timestamp " + literal
+	}
+	return literal
+}
+
+// advisoryKey is postgres advisory lock key of lock table
+func advisoryKey(table string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(table))
+	return int64(h.Sum64())
+}
+
+// pgAdvisoryLock is pg_locks condition of advisory lock of lock table
+func pgAdvisoryLock(table string) string {
+	key := uint64(advisoryKey(table))
+	return fmt.Sprintf("locktype = 'advisory' and classid = %d and objid = %d and objsubid = 1", key>>32, key&0xffffffff)
+}
+
+// acquireLock takes lock of apply and rollback, waits up to timeout if it is held by other run
+func acquireLock(ctx context.Context, db *sql.DB, config Config, timeout time.Duration) (*migrationLock, error) {
+	l := &migrationLock{table: config.historyTable() + "_lock", holder: lockHolder(), dialect: config.Dialect, ttl: LockTTL}
+	if config.LockTTL != "" {
+		ttl, err := time.ParseDuration(config.LockTTL)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("wrong lock_ttl '%s' in %s", config.LockTTL, ConfigPath)
+		}
+		l.ttl = ttl
+	}
+	if err := ensureLockTable(ctx, db, l.table, l.dialect); err != nil {
+		return nil, err
+	}
+	if l.dialect == "postgres" || l.dialect == "mysql" {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		l.conn = conn
+	}
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		ok, err := l.try(ctx, db)
+		if err != nil {
+			l.close()
+			return nil, fmt.Errorf("failed to lock migrations: %v", err)
+		}
+		if ok {
+			break
+		}
+		row, found, _ := readLockRow(ctx, db, l.table, l.dialect)
+		if time.Now().After(deadline) {
+			l.close()
+			if found {
+				return nil, fmt.Errorf("migrations are %s, use --lock-timeout to wait or unlock --force", row)
+			}
+			return nil, fmt.Errorf("migrations are locked by other session, use --lock-timeout to wait or unlock --force")
+		}
+		if !waiting && found {
+			fmt.Printf("waiting for lock, %s\n", row)
+			waiting = true
+		}
+		time.Sleep(min(time.Second, time.Until(deadline)))
+	}
+	l.stop = make(chan struct{})
+	l.done.Add(1)
+	go l.prolong(db)
+	return l, nil
+}
+
+// try takes lock at once, lock row is written for advisory lock as holder record
+func (l *migrationLock) try(ctx context.Context, db *sql.DB) (bool, error) {
+	now := time.Now()
+	insert := fmt.Sprintf("insert into %s (id, holder, acquired_at, expires_at) values (1, %s, %s, %s)",
+		l.table, sqlQuote(l.holder), timestampLiteral(now, l.dialect), timestampLiteral(now.Add(l.ttl), l.dialect))
+	var locked sql.NullInt64
+	switch l.dialect {
+	case "postgres":
+		var ok bool
+		if err := l.conn.QueryRowContext(ctx, fmt.Sprintf("select pg_try_advisory_lock(%d)", advisoryKey(l.table))).Scan(&ok); err != nil || !ok {
+			return false, err
+		}
+	case "mysql":
+		if err := l.conn.QueryRowContext(ctx, fmt.Sprintf("select get_lock(%s, 0)", sqlQuote(l.table))).Scan(&locked); err != nil || locked.Int64 != 1 {
+			return false, err
+		}
+	default:
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("delete from %s where expires_at < %s", l.table, timestampLiteral(now, l.dialect))); err != nil {
+			return false, err
+		}
+		if _, err := db.ExecContext(ctx, insert); err != nil {
+			// primary key violation if row of other holder is there
+			if _, found, rowErr := readLockRow(ctx, db, l.table, l.dialect); rowErr == nil && found {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	}
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("delete from %s where id = 1", l.table)); err != nil {
+		return true, err
+	}
+	_, err := db.ExecContext(ctx, insert)
+	return true, err
+}
+
+// prolong moves expiry of lock row while lock is held
+func (l *migrationLock) prolong(db *sql.DB) {
+	defer l.done.Done()
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			_, err := db.Exec(fmt.Sprintf("update %s set expires_at = %s where id = 1 and holder = %s",
+				l.table, timestampLiteral(time.Now().Add(l.ttl), l.dialect), sqlQuote(l.holder)))
+			if err != nil {
+				fmt.Println("ERROR: failed to prolong lock:", err)
+			}
+		}
+	}
+}
+
+// release removes lock row and advisory lock
+func (l *migrationLock) release(ctx context.Context, db *sql.DB) {
+	if l.stop != nil {
+		close(l.stop)
+		l.done.Wait()
+	}
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("delete from %s where id = 1 and holder = %s", l.table, sqlQuote(l.holder))); err != nil {
+		fmt.Println("ERROR: failed to release lock:", err)
+	}
+	l.close()
+}
+
+// close ends session of advisory lock, which releases it
+func (l *migrationLock) close() {
+	if l.conn == nil {
+		return
+	}
+	switch l.dialect {
+	case "postgres":
+		l.conn.ExecContext(context.Background(), fmt.Sprintf("select pg_advisory_unlock(%d)", advisoryKey(l.table)))
+	case "mysql":
+		l.conn.ExecContext(context.Background(), fmt.Sprintf("select release_lock(%s)", sqlQuote(l.table)))
+	}
+	l.conn.Close()
+}
+
+// unlock prints lock holder and removes stale lock row, with force removes lock row and terminates database session holding advisory lock
+func unlock(opts dbOptions, force bool) error {
+	ctx := context.Background()
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	db, err := openDB(opts, config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	table := config.historyTable() + "_lock"
+	if err := ensureLockTable(ctx, db, table, config.Dialect); err != nil {
+		return err
+	}
+	row, found, err := readLockRow(ctx, db, table, config.Dialect)
+	if err != nil {
+		return err
+	}
+	if found {
+		fmt.Println(row)
+	}
+	if found && row.stale && !force {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("delete from %s where id = 1 and holder = %s", table, sqlQuote(row.holder))); err != nil {
+			return err
+		}
+		fmt.Println("[ok] stale lock removed")
+		return nil
+	}
+	if !force {
+		if found {
+			return fmt.Errorf("use unlock --force to remove lock")
+		}
+		fmt.Println("[ok] migrations are not locked")
+		return nil
+	}
+	switch config.Dialect {
+	case "postgres":
+		_, err = db.ExecContext(ctx, fmt.Sprintf("select pg_terminate_backend(pid) from pg_locks where %s", pgAdvisoryLock(table)))
+	case "mysql":
+		var id sql.NullInt64
+		if err = db.QueryRowContext(ctx, fmt.Sprintf("select is_used_lock(%s)", sqlQuote(table))).Scan(&id); err == nil && id.Valid {
+			_, err = db.ExecContext(ctx, fmt.Sprintf("kill %d", id.Int64))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to end session holding lock: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("delete from %s where id = 1", table)); err != nil {
+		return err
+	}
+	fmt.Println("[ok] lock removed")
+	return nil
 }